@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/reddit/baseplate.go/log"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// RevokeURL is the Google OAuth token revocation endpoint.
+const RevokeURL = `https://oauth2.googleapis.com/revoke`
+
+// runAuth runs the auth subcommand sub, e.g. "login".
+//
+// Flags after the subcommand are already parsed by parseAuthArgs.
+func runAuth(cfg Config, sub string) {
+	ctx := getClientContext(context.Background(), cfg.HTTPClient)
+	pa := ProfileArgs(cfg, *configDir, *profile)
+	switch sub {
+	default:
+		flag.Usage()
+	case "login":
+		pa.Force = true
+		client, scopes, err := GetOAuthClient(ctx, pa, cfg.OAuthClient)
+		if err != nil {
+			log.Fatalw("Unable to login", "profile", *profile, "err", err)
+		}
+		email, err := accountEmail(ctx, client)
+		if err != nil {
+			log.Fatalw("Unable to get account info", "profile", *profile, "err", err)
+		}
+		fmt.Printf("Profile %s logged in as %s with scopes %v\n", *profile, email, scopes)
+	case "list":
+		authList(ctx, os.Stdout, cfg)
+	case "logout":
+		if err := pa.store().Delete(*profile); err != nil {
+			log.Fatalw("Unable to logout", "profile", *profile, "err", err)
+		}
+		fmt.Printf("Profile %s logged out\n", *profile)
+	case "revoke":
+		store := pa.store()
+		token, err := store.Load(*profile)
+		if err != nil {
+			log.Fatalw("Unable to load token", "profile", *profile, "err", err)
+		}
+		if err := revokeToken(ctx, RevokeURL, &token.Token); err != nil {
+			log.Fatalw("Unable to revoke token", "profile", *profile, "err", err)
+		}
+		if err := store.Delete(*profile); err != nil {
+			log.Fatalw("Unable to delete revoked token", "profile", *profile, "err", err)
+		}
+		fmt.Printf("Profile %s revoked and logged out\n", *profile)
+	}
+}
+
+// parseAuthArgs parses the flags after the auth subcommand,
+// e.g. "auth login -profile work", and returns the subcommand.
+//
+// args are the args after "auth".
+// It must be called before loading the config,
+// as the flags could include -config-dir.
+func parseAuthArgs(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	flag.CommandLine.Parse(args[1:])
+	return args[0]
+}
+
+// authList prints all the profiles with their accounts and token expiry.
+func authList(ctx context.Context, out io.Writer, cfg Config) {
+	store := NewTokenStore(*configDir, cfg.TokenStore)
+	profiles, err := store.List()
+	if err != nil {
+		log.Fatalw("Unable to list profiles", "err", err)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "PROFILE\tACCOUNT\tEXPIRY")
+
+	for _, name := range profiles {
+		token, err := store.Load(name)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t(error: %v)\t\n", name, err)
+			continue
+		}
+		config := cfg.OAuthClient.config(token.requested())
+		ts := newPersistentTokenSource(ctx, config, store, name, token)
+		email, err := accountEmail(ctx, oauth2.NewClient(ctx, ts))
+		if err != nil {
+			email = fmt.Sprintf("(error: %v)", err)
+		}
+		// The token could be refreshed by the request above.
+		expiry := token.Expiry
+		if current, err := ts.Token(); err == nil {
+			expiry = current.Expiry
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, email, expiry.Local().Format(time.RFC3339))
+	}
+
+	// Service account profiles don't have tokens stored.
+	var accounts []string
+	for name, pc := range cfg.Profiles {
+		if pc.ServiceAccount.KeyFile != "" {
+			accounts = append(accounts, name)
+		}
+	}
+	sort.Strings(accounts)
+	for _, name := range accounts {
+		sa := cfg.Profiles[name].ServiceAccount
+		config, err := sa.jwtConfig(*configDir, nil)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t(error: %v)\t\n", name, err)
+			continue
+		}
+		account := "service account " + config.Email
+		if sa.Subject != "" {
+			account += " as " + sa.Subject
+		}
+		fmt.Fprintf(w, "%s\t%s\t-\n", name, account)
+	}
+}
+
+// accountEmail returns the email address of the Drive account of client.
+func accountEmail(ctx context.Context, client *http.Client) (string, error) {
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return "", err
+	}
+	about, err := srv.About.Get().Context(ctx).Fields("user(emailAddress)").Do()
+	if err != nil {
+		return "", err
+	}
+	return about.User.EmailAddress, nil
+}
+
+// revokeToken revokes the token at the revocation endpoint.
+//
+// Revoking the refresh token also revokes all the access tokens from it.
+func revokeToken(ctx context.Context, revokeURL string, token *oauth2.Token) error {
+	value := token.RefreshToken
+	if value == "" {
+		value = token.AccessToken
+	}
+	var resp struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := postForm(ctx, revokeURL, url.Values{"token": {value}}, &resp)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("revoke failed with status %d: %s %s", status, resp.Error, resp.ErrorDescription)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestRevokeToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("token") != "refresh-token" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "invalid_token"}`))
+				return
+			}
+			w.Write([]byte(`{}`))
+		},
+	))
+	defer server.Close()
+
+	for _, c := range []struct {
+		Label string
+		Token oauth2.Token
+		Err   bool
+	}{
+		{
+			Label: "refresh-token",
+			Token: oauth2.Token{
+				AccessToken:  "access-token",
+				RefreshToken: "refresh-token",
+			},
+		},
+		{
+			Label: "invalid",
+			Token: oauth2.Token{
+				RefreshToken: "invalid",
+			},
+			Err: true,
+		},
+	} {
+		t.Run(
+			c.Label,
+			func(t *testing.T) {
+				err := revokeToken(context.Background(), server.URL, &c.Token)
+				if c.Err != (err != nil) {
+					t.Errorf("revokeToken expected error %v, got %v", c.Err, err)
+				}
+			},
+		)
+	}
+}
+
+func TestPlainTokenStoreList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokenstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewTokenStore(dir, TokenStoreConfig{})
+	for _, profile := range []string{"work", "default"} {
+		if err := store.Save(profile, &profileToken{
+			Token: oauth2.Token{RefreshToken: "refresh-token"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A service account key in the same directory.
+	if err := ioutil.WriteFile(
+		filepath.Join(dir, "key.json"),
+		[]byte(`{"type": "service_account"}`),
+		0600,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"default", "work"}
+	profiles, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(profiles, expected) {
+		t.Errorf("Expected profiles %v, got %v", expected, profiles)
+	}
+
+	if err := store.Delete("work"); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"default"}
+	profiles, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(profiles, expected) {
+		t.Errorf("Expected profiles %v after logout, got %v", expected, profiles)
+	}
+}
+
+func TestParseAuthArgs(t *testing.T) {
+	defer func(dir, p string) {
+		*configDir, *profile = dir, p
+	}(*configDir, *profile)
+
+	sub := parseAuthArgs([]string{"login", "-config-dir", "/tmp/other", "-profile", "work"})
+	if sub != "login" {
+		t.Errorf("Expected subcommand login, got %q", sub)
+	}
+	if *configDir != "/tmp/other" {
+		t.Errorf("Expected config dir /tmp/other, got %q", *configDir)
+	}
+	if *profile != "work" {
+		t.Errorf("Expected profile work, got %q", *profile)
+	}
+	if sub := parseAuthArgs(nil); sub != "" {
+		t.Errorf("Expected no subcommand, got %q", sub)
+	}
+}
+
+func TestAuthListServiceAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) {
+		*configDir = d
+	}(*configDir)
+	*configDir = dir
+
+	for file, content := range map[string]string{
+		"key.json":     `{"type": "service_account", "client_email": "sa@example.iam.gserviceaccount.com", "private_key": "key"}`,
+		"invalid.json": `{"type": "authorized_user"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := Config{
+		Profiles: map[string]ProfileConfig{
+			"good": {
+				ServiceAccount: ServiceAccountConfig{
+					KeyFile: "key.json",
+					Subject: "user@example.com",
+				},
+			},
+			"invalid": {
+				ServiceAccount: ServiceAccountConfig{KeyFile: "invalid.json"},
+			},
+			"missing": {
+				ServiceAccount: ServiceAccountConfig{KeyFile: "missing.json"},
+			},
+			"user": {},
+		},
+	}
+	var out bytes.Buffer
+	authList(context.Background(), &out, cfg)
+
+	rows := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n")[1:] {
+		fields := strings.Fields(line)
+		rows[fields[0]] = strings.Join(fields[1:], " ")
+	}
+	if len(rows) != 3 {
+		t.Errorf("Expected 3 service account rows, got %q", out.String())
+	}
+	if row, expected := rows["good"], "service account sa@example.iam.gserviceaccount.com as user@example.com -"; row != expected {
+		t.Errorf("Expected row %q, got %q", expected, row)
+	}
+	for _, name := range []string{"invalid", "missing"} {
+		if !strings.HasPrefix(rows[name], "(error: ") {
+			t.Errorf("Expected error row for %s, got %q", name, rows[name])
+		}
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper calling the function.
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestAuthListRefreshedExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) {
+		*configDir = d
+	}(*configDir)
+	*configDir = dir
+
+	store := NewTokenStore(dir, TokenStoreConfig{})
+	if err := store.Save("user", &profileToken{
+		Token: oauth2.Token{
+			AccessToken:  "expired",
+			RefreshToken: "refresh-token",
+			Expiry:       time.Now().Add(-time.Hour),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Serves the requests to Google APIs.
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", "application/json")
+		switch {
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			rec.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, "/token"):
+			rec.WriteString(`{"access_token": "refreshed", "token_type": "Bearer", "expires_in": 3600}`)
+		case strings.HasSuffix(r.URL.Path, "/about"):
+			if auth := r.Header.Get("Authorization"); auth != "Bearer refreshed" {
+				t.Errorf("Expected refreshed token, got %q", auth)
+			}
+			rec.WriteString(`{"user": {"emailAddress": "user@example.com"}}`)
+		}
+		return rec.Result(), nil
+	})
+	ctx := context.WithValue(
+		context.Background(),
+		oauth2.HTTPClient,
+		&http.Client{Transport: transport},
+	)
+	var out bytes.Buffer
+	authList(ctx, &out, Config{})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 1 profile row, got %q", out.String())
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) != 3 || fields[0] != "user" || fields[1] != "user@example.com" {
+		t.Fatalf("Unexpected row %q", lines[1])
+	}
+	expiry, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry.After(time.Now()) {
+		t.Errorf("Expected expiry of the refreshed token, got %v", expiry)
+	}
+}
@@ -21,6 +21,10 @@ const (
 	DefaultLogLevel = log.InfoLevel
 )
 
+// DefaultInodeFilename is the filename used under the daemon directory when
+// fs.inode_file is not set.
+const DefaultInodeFilename = "inodes.map"
+
 // Config defines the structure of the main config file used.
 type Config struct {
 	// log level used, default to info level.
@@ -28,10 +32,17 @@ type Config struct {
 
 	OAuthClient OAuthClientConfig `yaml:"oauth_client"`
 
+	// Per profile configs, keys are profile names.
+	Profiles map[string]ProfileConfig `yaml:"profiles"`
+
+	TokenStore TokenStoreConfig `yaml:"token_store"`
+
 	HTTPClient HTTPClientConfig `yaml:"http_client"`
 
 	Daemon DaemonConfig `yaml:"daemon"`
 
+	FS gfs.Options `yaml:"fs"`
+
 	Mountpoints gfs.Mountpoints `yaml:"mountpoints"`
 }
 
@@ -45,6 +56,13 @@ func ParseConfig(f io.Reader) (cfg Config, err error) {
 	if cfg.LogLevel == "" {
 		cfg.LogLevel = DefaultLogLevel
 	}
+	if cfg.FS.InodeFile == "" {
+		dir := cfg.Daemon.Dir
+		if dir == "" {
+			dir = getDefaultDaemonDir()
+		}
+		cfg.FS.InodeFile = filepath.Join(dir, DefaultInodeFilename)
+	}
 	return
 }
 
@@ -94,6 +112,53 @@ oauth_client:
   client_id:
   client_secret:
 
+# Per profile configs, keys are profile names used by -profile flag.
+profiles:
+  default:
+    # The OAuth scopes to request, the profile will be authorized again when
+    # they are changed. Scopes without a scheme are relative to
+    # https://www.googleapis.com/auth/, for example:
+    # - drive: full access (default)
+    # - drive.readonly: read-only access, mountpoints will be read-only
+    # - drive.file: only the files created by godrive-fuse
+    # - drive.metadata.readonly: read-only access to metadata, reading files
+    #   will fail with EACCES
+    scopes:
+    # The OAuth flow used to authorize the profile, should be one of:
+    # - loopback: open the link in a browser on the same machine (default)
+    # - device: enter a code on another device, for headless servers,
+    #   only drive.file and drive.appdata scopes are allowed by Google
+    # Can be overridden by -auth-flow flag.
+    flow:
+    # Authenticate as a service account instead of using oauth_client,
+    # for example to mount shared drives on shared infrastructure.
+    service_account:
+      # The path to the JSON key file of the service account,
+      # relative paths are relative to the config directory.
+      key_file:
+      # The email of the user to impersonate with domain-wide delegation.
+      # Leave empty to use the service account itself.
+      subject:
+
+# How to store the tokens of profiles
+token_store:
+  # Encrypt the tokens instead of storing them as plaintext json files.
+  # Existing plaintext tokens will be migrated when they are used.
+  # The key comes from the first one set of the following,
+  # or the passphrase will be prompted if none of them are set,
+  # which only works for mount with -no-daemon.
+  # Default is false.
+  encrypt:
+  # The environment variable to read the passphrase from.
+  passphrase_env:
+  # The file to read the passphrase from.
+  passphrase_file:
+  # The file containing the base64 encoded 32-byte key,
+  # e.g. generated by "head -c 32 /dev/urandom | base64".
+  key_file:
+  # The command to print the passphrase, e.g. "pass show godrive-fuse".
+  key_command:
+
 # HTTP client related configs, controls both OAuth flow and Google Drive API
 http_client:
   # A go time.Duration format string, e.g. "5s" means "5 seconds".
@@ -112,11 +177,72 @@ daemon:
   # Default is 0 (don't cleanup anything).
   cleanup_days:
 
-# A string -> string map of mountpoints.
-# Keys are local directories, and values are google drive directories.
+# Filesystem related configs, shared by all mountpoints
+fs:
+  # What to do when a file was changed on Drive after we loaded it,
+  # should be one of:
+  # - overwrite: overwrite the changes on Drive with our version
+  # - fail: fail the write (close/fsync) with ESTALE, keep the changes on Drive
+  # - copy: upload our version as a new file next to it named like
+  #   "file (conflict 2006-01-02 hostname).ext"
+  # Default is copy.
+  conflict_policy:
+  # How to map owners of files on Drive to local users and groups.
+  # Files owned by you are always owned by the user running the mount.
+  owners:
+    # Keys are email addresses of the owners on Drive,
+    # values are local user and group, either by name or numeric id.
+    # If group is omitted, the primary group of the user will be used.
+    users:
+      #alice@example.com:
+      #  user: alice
+      #  group: staff
+    # Keys are domains of the owners' email addresses,
+    # used when the email address is not in users.
+    domains:
+      #example.com:
+      #  user: nobody
+      #  group: staff
+    # Used by owners not mapped above.
+    # Default is the user running the mount.
+    default_uid:
+    default_gid:
+  # The file to persist the inode numbers allocated to files,
+  # so that they stay stable across restarts.
+  # It's locked while mounted, so daemons running at the same time need
+  # different files, otherwise only the first one persists its inodes.
+  # Default is inodes.map under daemon.dir.
+  inode_file:
+
+# A map of mountpoints.
+# Keys are local directories, and values are either google drive directories
+# or folder ids in the form of "id:1AbC...", or maps of options like:
+#   source: google drive directory or "id:1AbC...", default is "/"
+#   shared_drive: id of the shared drive to mount from, default is My Drive
+#   profile: the profile to use, default is the one from -profile flag,
+#     mountpoints using different profiles can be mounted in the same daemon
+#   read_only: true to mount it read-only
+#   uid, gid: report all files as owned by them instead of the owners config
+#   umask: permission bits to remove from all files, e.g. 022
+#   cache: auto (default), none (always look up names on Drive),
+#     or full (let kernel cache for a minute)
+#   delete_mode: unparent (default for My Drive), trash (default for shared
+#     drives), or permanent
+#   allow_other: true to allow other users to access it,
+#     requires user_allow_other in /etc/fuse.conf
 mountpoints:
   # Uncomment the next line to mount your whole google drive to /tmp/drive:
   #/tmp/drive: /
+  # Uncomment the next line to mount a folder by its id to /tmp/shared:
+  #/tmp/shared: id:1AbC...
+  # Uncomment the next lines to mount a shared drive read-only to /tmp/team:
+  #/tmp/team:
+  #  shared_drive: 0AbC...
+  #  read_only: true
+  # Uncomment the next lines to mount the drive of the "work" profile to
+  # /tmp/work, run "auth login -profile work" first:
+  #/tmp/work:
+  #  profile: work
 `
 
 // In this file we cannot use baseplate log yet, so use this function to panic
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+)
+
+// DeviceAuthURL is the Google OAuth device authorization endpoint.
+const DeviceAuthURL = `https://oauth2.googleapis.com/device/code`
+
+// The grant type used when polling the token endpoint in device flow.
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Polling intervals in device flow,
+// a var instead of const so that tests can speed it up.
+var (
+	// Used when the device authorization endpoint doesn't return an interval.
+	deviceDefaultInterval = time.Second * 5
+	// The unit of the interval returned by the device authorization endpoint,
+	// and also how much to slow down when asked to.
+	deviceIntervalUnit = time.Second
+)
+
+// DeviceScopes are the OAuth scopes allowed in device flow.
+//
+// Google only allows a few scopes in device flow,
+// notably the full drive and drive.readonly scopes are not among them.
+//
+// See https://developers.google.com/identity/protocols/oauth2/limited-input-device#allowedscopes
+var DeviceScopes = []string{
+	ScopePrefix + "userinfo.email",
+	ScopePrefix + "userinfo.profile",
+	drive.DriveAppdataScope,
+	drive.DriveFileScope,
+}
+
+// checkDeviceScopes returns an error if any of the scopes is not allowed in
+// device flow.
+func checkDeviceScopes(scopes []string) error {
+	for _, scope := range scopes {
+		var allowed bool
+		for _, s := range DeviceScopes {
+			if scope == s {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf(
+				"scope %q is not allowed in device flow, set scopes of the profile to drive.file (only the files created or opened by godrive-fuse), or use loopback flow instead",
+				scope,
+			)
+		}
+	}
+	return nil
+}
+
+type deviceAuthResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	// The name used by RFC 8628, Google uses verification_url instead.
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Interval        int64  `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// httpClientFromContext returns the http client set by getClientContext.
+func httpClientFromContext(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return client
+	}
+	return http.DefaultClient
+}
+
+func postForm(ctx context.Context, endpoint string, values url.Values, v interface{}) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClientFromContext(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// deviceFlow runs the OAuth device authorization flow.
+//
+// It calls show with the url and code the user need to enter on another
+// device, then polls the token endpoint until the user finished it.
+func deviceFlow(
+	ctx context.Context,
+	config *oauth2.Config,
+	deviceAuthURL string,
+	show func(verificationURL, userCode string),
+) (*oauth2.Token, error) {
+	if err := checkDeviceScopes(config.Scopes); err != nil {
+		return nil, err
+	}
+
+	var auth deviceAuthResponse
+	status, err := postForm(ctx, deviceAuthURL, url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {strings.Join(config.Scopes, " ")},
+	}, &auth)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization request failed: %w", err)
+	}
+	if status != http.StatusOK || auth.DeviceCode == "" {
+		return nil, fmt.Errorf("device authorization request failed with status %d", status)
+	}
+	if auth.VerificationURL == "" {
+		auth.VerificationURL = auth.VerificationURI
+	}
+	show(auth.VerificationURL, auth.UserCode)
+
+	interval := deviceDefaultInterval
+	if auth.Interval > 0 {
+		interval = time.Duration(auth.Interval) * deviceIntervalUnit
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	values := url.Values{
+		"client_id":     {config.ClientID},
+		"client_secret": {config.ClientSecret},
+		"device_code":   {auth.DeviceCode},
+		"grant_type":    {deviceGrantType},
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		if auth.ExpiresIn > 0 && time.Now().After(deadline) {
+			return nil, errors.New("device code expired")
+		}
+
+		var resp deviceTokenResponse
+		if _, err := postForm(ctx, config.Endpoint.TokenURL, values, &resp); err != nil {
+			return nil, fmt.Errorf("device token request failed: %w", err)
+		}
+		switch resp.Error {
+		case "":
+			tok := &oauth2.Token{
+				AccessToken:  resp.AccessToken,
+				TokenType:    resp.TokenType,
+				RefreshToken: resp.RefreshToken,
+			}
+			if resp.ExpiresIn > 0 {
+				tok.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+			}
+			return tok.WithExtra(map[string]interface{}{
+				"scope": resp.Scope,
+			}), nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * deviceIntervalUnit
+		default:
+			return nil, fmt.Errorf("device authorization failed: %s %s", resp.Error, resp.ErrorDescription)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	defer func(d, u time.Duration) {
+		deviceDefaultInterval, deviceIntervalUnit = d, u
+	}(deviceDefaultInterval, deviceIntervalUnit)
+	deviceDefaultInterval = time.Millisecond
+	deviceIntervalUnit = time.Millisecond
+
+	const (
+		deviceCode  = "fake-device-code"
+		userCode    = "ABCD-EFGH"
+		verifyURL   = "https://www.google.com/device"
+		accessToken = "fake-access-token"
+		scope       = "https://www.googleapis.com/auth/drive.file"
+	)
+	// The responses of the token endpoint, in order.
+	responses := []string{"authorization_pending", "slow_down", "authorization_pending", ""}
+	var polls int
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.FormValue("scope"); got != scope {
+			t.Errorf("Device endpoint expected scope %q, got %q", scope, got)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":      deviceCode,
+			"user_code":        userCode,
+			"verification_url": verifyURL,
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.FormValue("device_code"); got != deviceCode {
+			t.Errorf("Token endpoint expected device code %q, got %q", deviceCode, got)
+		}
+		if got := r.FormValue("grant_type"); got != deviceGrantType {
+			t.Errorf("Token endpoint expected grant type %q, got %q", deviceGrantType, got)
+		}
+		resp := responses[polls]
+		polls++
+		if resp != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": resp,
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  accessToken,
+			"token_type":    "Bearer",
+			"refresh_token": "fake-refresh-token",
+			"expires_in":    3600,
+			"scope":         scope,
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	config := &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{
+			TokenURL: server.URL + "/token",
+		},
+		Scopes: []string{scope},
+	}
+	var shown bool
+	tok, err := deviceFlow(
+		context.Background(),
+		config,
+		server.URL+"/device",
+		func(url, code string) {
+			shown = true
+			if url != verifyURL || code != userCode {
+				t.Errorf(
+					"Expected url %q and code %q, got %q and %q",
+					verifyURL, userCode, url, code,
+				)
+			}
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shown {
+		t.Error("Verification url and code not shown")
+	}
+	if polls != len(responses) {
+		t.Errorf("Expected %d polls, got %d", len(responses), polls)
+	}
+	if tok.AccessToken != accessToken {
+		t.Errorf("Expected access token %q, got %q", accessToken, tok.AccessToken)
+	}
+	if got := grantedScopes(tok, nil); len(got) != 1 || got[0] != scope {
+		t.Errorf("Expected granted scopes [%q], got %q", scope, got)
+	}
+}
+
+func TestDeviceFlowScopes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request to %s", r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	for _, scopes := range [][]string{
+		DefaultScopes,
+		NormalizeScopes([]string{"drive.readonly"}),
+		NormalizeScopes([]string{"drive.file", "drive.metadata.readonly"}),
+	} {
+		t.Run(strings.Join(scopes, ","), func(t *testing.T) {
+			config := &oauth2.Config{
+				ClientID: "client",
+				Endpoint: oauth2.Endpoint{
+					TokenURL: server.URL + "/token",
+				},
+				Scopes: scopes,
+			}
+			_, err := deviceFlow(
+				context.Background(),
+				config,
+				server.URL+"/device",
+				func(url, code string) {
+					t.Error("Verification url and code shown for disallowed scopes")
+				},
+			)
+			if err == nil {
+				t.Fatal("Expected error for disallowed scopes")
+			}
+			if !strings.Contains(err.Error(), "drive.file") {
+				t.Errorf("Expected error to suggest drive.file, got %v", err)
+			}
+		})
+	}
+}
@@ -22,6 +22,11 @@ var (
 		"default",
 		"If you have more than one google account, use this to contrrol which account to use",
 	)
+	authFlow = flag.String(
+		"auth-flow",
+		"",
+		`The OAuth flow used when authorizing a profile, overrides the flow in profile config. "loopback" (default) or "device" for headless servers`,
+	)
 	noDaemon = flag.Bool(
 		"no-daemon",
 		false,
@@ -54,10 +59,20 @@ Commands:
   init:
 	Initialize the config file before first use.
 
+  auth login|list|logout|revoke [-profile profile]:
+	Manage the authorized Google accounts.
+	login: Authorize the profile, run it before mounting with the profile.
+	list: List all the profiles with their accounts and token expiry.
+	logout: Delete the saved token of the profile.
+	revoke: Revoke the token of the profile on Google, then delete it.
+
   mount [drive-directory] [local-directory]:
 	Mount the specified Drive directory to the local directory.
 	If drive-directory is omitted, root Google Drive directory will be used.
+	drive-directory can also be a folder id in the form of "id:1AbC...".
 	If both args are omitted, map all mountpoints defined in the config file instead.
+	Mountpoints in the config file can use different profiles, which all need to
+	be authorized with auth login first.
 
 Args:
 `,
@@ -3,6 +3,8 @@ package gdrive
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"io"
 	"path"
@@ -28,6 +30,10 @@ const (
 	NotFolderQString = `mimeType != '` + FolderMimeType + `'`
 )
 
+// IDPrefix is the prefix used by ResolveFolder to refer to a folder by its id
+// instead of its path, e.g. "id:1AbC...".
+const IDPrefix = "id:"
+
 // Default page size used by list calls.
 const (
 	PageSize = 50
@@ -36,6 +42,14 @@ const (
 // ErrBreak is an error can be used in ListFiles to break the list early.
 var ErrBreak = errors.New("break list")
 
+// ErrNotFolder is the error returned by ResolveFolder when the given id is not
+// a folder.
+var ErrNotFolder = errors.New("not a folder")
+
+// ErrMD5Mismatch is the error returned by DownloadByID when the downloaded
+// content doesn't match the expected md5 checksum.
+var ErrMD5Mismatch = errors.New("downloaded content md5 mismatch")
+
 func splitPath(name string) []string {
 	name = path.Clean(name)
 	if name == "." || name == "/" {
@@ -46,12 +60,56 @@ func splitPath(name string) []string {
 }
 
 // FindFile finds the file or directory on Drive by it's full path.
+//
+// The path is relative to the shared drive if DriveID is set,
+// or My Drive otherwise.
+//
+// For the root directory ("/"), the real id behind the RootID alias is
+// returned, so that it can be compared against parents of other files.
 func (tc TracedClient) FindFile(ctx context.Context, name string, qStrings ...string) (string, error) {
 	parts := splitPath(name)
 	if len(parts) == 0 {
-		return RootID, nil
+		return tc.ResolveRootID(ctx)
+	}
+	root := RootID
+	if tc.DriveID != "" {
+		root = tc.DriveID
+	}
+	return tc.findFileRecursive(ctx, root, parts, qStrings...)
+}
+
+// ResolveFolder resolves source into the id of a folder on Drive.
+//
+// source is either a full path, or a folder id prefixed with IDPrefix.
+// Ids skip the path resolution but are still validated to be folders,
+// they also work with folders not in My Drive, for example shared with us.
+func (tc TracedClient) ResolveFolder(ctx context.Context, source string) (string, error) {
+	id := strings.TrimPrefix(source, IDPrefix)
+	if id == source {
+		return tc.FindFile(ctx, source, FolderQString)
+	}
+	f, err := tc.GetByID(ctx, id, "id, mimeType")
+	if err != nil {
+		return "", err
 	}
-	return tc.findFileRecursive(ctx, RootID, parts, qStrings...)
+	if f.MimeType != FolderMimeType {
+		return "", ErrNotFolder
+	}
+	return f.Id, nil
+}
+
+// ResolveRootID returns the real id of the root directory,
+// which is the shared drive if DriveID is set, or My Drive otherwise.
+func (tc TracedClient) ResolveRootID(ctx context.Context) (string, error) {
+	if tc.DriveID != "" {
+		// The root folder of a shared drive has the same id as the drive.
+		return tc.DriveID, nil
+	}
+	f, err := tc.GetByID(ctx, RootID, "id")
+	if err != nil {
+		return "", err
+	}
+	return f.Id, nil
 }
 
 func (tc TracedClient) findFileRecursive(ctx context.Context, parentID string, parts []string, addQ ...string) (string, error) {
@@ -115,7 +173,13 @@ func (tc TracedClient) ListFiles(
 	callback func(f *drive.File) error,
 	qStrings ...string,
 ) error {
-	list := tc.Files.List().PageSize(PageSize).Corpora("user").Fields(googleapi.Field(fields))
+	list := tc.Files.List().PageSize(PageSize).Fields(googleapi.Field(fields))
+	list.SupportsAllDrives(true).IncludeItemsFromAllDrives(true)
+	if tc.DriveID != "" {
+		list.Corpora("drive").DriveId(tc.DriveID)
+	} else {
+		list.Corpora("user")
+	}
 	list.OrderBy("folder,name")
 	qStrings = append(qStrings, `'`+parentID+`' in parents`)
 	qString := strings.Join(qStrings, ` and `)
@@ -144,8 +208,11 @@ func (tc TracedClient) ListFiles(
 }
 
 // DownloadByID downloads the file content by its id.
-func (tc TracedClient) DownloadByID(ctx context.Context, id string) (*bytes.Buffer, error) {
-	get := tc.Files.Get(id).Context(ctx)
+//
+// If md5Checksum is non-empty, the downloaded content is verified against it,
+// and ErrMD5Mismatch will be returned if it doesn't match.
+func (tc TracedClient) DownloadByID(ctx context.Context, id, md5Checksum string) (*bytes.Buffer, error) {
+	get := tc.Files.Get(id).Context(ctx).SupportsAllDrives(true)
 	resp, err := get.Download()
 	if err != nil {
 		tc.Logger.Errorw(
@@ -157,7 +224,8 @@ func (tc TracedClient) DownloadByID(ctx context.Context, id string) (*bytes.Buff
 	}
 	defer resp.Body.Close()
 	var buffer bytes.Buffer
-	read, err := io.Copy(&buffer, resp.Body)
+	hash := md5.New()
+	read, err := io.Copy(io.MultiWriter(&buffer, hash), resp.Body)
 	if err != nil {
 		tc.Logger.Errorw(
 			"DownloadByID",
@@ -167,6 +235,19 @@ func (tc TracedClient) DownloadByID(ctx context.Context, id string) (*bytes.Buff
 		)
 		return nil, err
 	}
+	if md5Checksum != "" {
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != md5Checksum {
+			tc.Logger.Errorw(
+				"DownloadByID",
+				"err", ErrMD5Mismatch,
+				"id", id,
+				"read", read,
+				"expected", md5Checksum,
+				"actual", actual,
+			)
+			return nil, ErrMD5Mismatch
+		}
+	}
 	tc.Logger.Debugw(
 		"DownloadByID",
 		"id", id,
@@ -177,7 +258,7 @@ func (tc TracedClient) DownloadByID(ctx context.Context, id string) (*bytes.Buff
 
 // GetByID gets the file metadata by its id.
 func (tc TracedClient) GetByID(ctx context.Context, id, fields string) (f *drive.File, err error) {
-	get := tc.Files.Get(id).Context(ctx)
+	get := tc.Files.Get(id).Context(ctx).SupportsAllDrives(true)
 	f, err = get.Fields(googleapi.Field(fields)).Do()
 	if err != nil {
 		tc.Logger.Errorw(
@@ -190,9 +271,12 @@ func (tc TracedClient) GetByID(ctx context.Context, id, fields string) (f *drive
 }
 
 // UpdateMediaByID updates the file content by its id.
-func (tc TracedClient) UpdateMediaByID(ctx context.Context, id string, r io.Reader) (f *drive.File, err error) {
-	update := tc.Files.Update(id, nil).Context(ctx).Media(r, googleapi.ChunkSize(256*1024))
-	f, err = update.Do()
+//
+// meta is optional. If it's non-nil, the metadata changes in it will be applied
+// in the same request.
+func (tc TracedClient) UpdateMediaByID(ctx context.Context, id, fields string, meta *drive.File, r io.Reader) (f *drive.File, err error) {
+	update := tc.Files.Update(id, meta).Context(ctx).SupportsAllDrives(true).Media(r, googleapi.ChunkSize(256*1024))
+	f, err = update.Fields(googleapi.Field(fields)).Do()
 	if err != nil {
 		tc.Logger.Errorw(
 			"UpdateMediaByID",
@@ -203,12 +287,26 @@ func (tc TracedClient) UpdateMediaByID(ctx context.Context, id string, r io.Read
 	return
 }
 
+// UpdateByID applies the metadata changes in meta to the file by its id.
+func (tc TracedClient) UpdateByID(ctx context.Context, id, fields string, meta *drive.File) (f *drive.File, err error) {
+	update := tc.Files.Update(id, meta).Context(ctx).SupportsAllDrives(true)
+	f, err = update.Fields(googleapi.Field(fields)).Do()
+	if err != nil {
+		tc.Logger.Errorw(
+			"UpdateByID",
+			"err", err,
+			"id", id,
+		)
+	}
+	return
+}
+
 // DeleteByID removes the given parent id from the file's parents list.
 //
 // Note that for directories this also deletes all its contents.
 // It's caller's responsibility to ensure that it's empty.
 func (tc TracedClient) DeleteByID(ctx context.Context, id, parentID string) (err error) {
-	update := tc.Files.Update(id, nil).Context(ctx)
+	update := tc.Files.Update(id, nil).Context(ctx).SupportsAllDrives(true)
 	update.RemoveParents(parentID)
 	_, err = update.Do()
 	if err != nil {
@@ -222,6 +320,37 @@ func (tc TracedClient) DeleteByID(ctx context.Context, id, parentID string) (err
 	return
 }
 
+// TrashByID moves the file to the trash.
+//
+// Note that for directories this also trashes all its contents.
+func (tc TracedClient) TrashByID(ctx context.Context, id string) (err error) {
+	update := tc.Files.Update(id, &drive.File{Trashed: true}).Context(ctx).SupportsAllDrives(true)
+	_, err = update.Do()
+	if err != nil {
+		tc.Logger.Errorw(
+			"TrashByID",
+			"err", err,
+			"id", id,
+		)
+	}
+	return
+}
+
+// RemoveByID permanently deletes the file, skipping the trash.
+//
+// Note that for directories this also deletes all its contents.
+func (tc TracedClient) RemoveByID(ctx context.Context, id string) (err error) {
+	err = tc.Files.Delete(id).Context(ctx).SupportsAllDrives(true).Do()
+	if err != nil {
+		tc.Logger.Errorw(
+			"RemoveByID",
+			"err", err,
+			"id", id,
+		)
+	}
+	return
+}
+
 // Create creates a new file/directory under parent with given name.
 func (tc TracedClient) Create(ctx context.Context, name, parentID string, isDir bool) (file *drive.File, err error) {
 	file = &drive.File{
@@ -231,7 +360,7 @@ func (tc TracedClient) Create(ctx context.Context, name, parentID string, isDir
 	if isDir {
 		file.MimeType = FolderMimeType
 	}
-	create := tc.Files.Create(file).Context(ctx)
+	create := tc.Files.Create(file).Context(ctx).SupportsAllDrives(true)
 	if !isDir {
 		create = create.Media(bytes.NewReader([]byte{}))
 	}
@@ -247,3 +376,67 @@ func (tc TracedClient) Create(ctx context.Context, name, parentID string, isDir
 	}
 	return
 }
+
+// CopyByID creates a copy of the file under parent with given name.
+//
+// The content is copied on Drive's side without being downloaded.
+func (tc TracedClient) CopyByID(ctx context.Context, id, name, parentID, fields string) (file *drive.File, err error) {
+	file = &drive.File{
+		Name:    name,
+		Parents: []string{parentID},
+	}
+	file, err = tc.Files.Copy(id, file).Context(ctx).SupportsAllDrives(true).Fields(googleapi.Field(fields)).Do()
+	if err != nil {
+		tc.Logger.Errorw(
+			"CopyByID",
+			"err", err,
+			"id", id,
+			"name", name,
+			"parentID", parentID,
+		)
+	}
+	return
+}
+
+// CreateWithMedia creates a new file under parent with given name and content
+// in a single upload request.
+//
+// Small contents are uploaded with a multipart request,
+// larger contents are uploaded with a resumable upload.
+//
+// meta is optional. If it's non-nil, the other metadata in it will be used for
+// the new file.
+func (tc TracedClient) CreateWithMedia(ctx context.Context, name, parentID, fields string, meta *drive.File, r io.Reader) (file *drive.File, err error) {
+	file = new(drive.File)
+	if meta != nil {
+		*file = *meta
+	}
+	file.Name = name
+	file.Parents = []string{parentID}
+	create := tc.Files.Create(file).Context(ctx).SupportsAllDrives(true).Media(r, googleapi.ChunkSize(256*1024))
+	file, err = create.Fields(googleapi.Field(fields)).Do()
+	if err != nil {
+		tc.Logger.Errorw(
+			"CreateWithMedia",
+			"err", err,
+			"name", name,
+			"parentID", parentID,
+		)
+	}
+	return
+}
+
+// GetStorageQuota gets the storage quota of the user.
+//
+// Limit in the returned quota is 0 if the user has unlimited storage.
+func (tc TracedClient) GetStorageQuota(ctx context.Context) (quota *drive.AboutStorageQuota, err error) {
+	about, err := tc.About.Get().Context(ctx).Fields("storageQuota").Do()
+	if err != nil {
+		tc.Logger.Errorw(
+			"GetStorageQuota",
+			"err", err,
+		)
+		return nil, err
+	}
+	return about.StorageQuota, nil
+}
@@ -1,10 +1,38 @@
 package gdrive
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
 	"reflect"
+	"strings"
 	"testing"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
 )
 
+// newTestClient returns a TracedClient sending all requests to handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) TracedClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	srv, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTracedClient(srv, zap.NewNop().Sugar())
+}
+
 func TestSplitPath(t *testing.T) {
 	for _, c := range []struct {
 		Name     string
@@ -51,3 +79,116 @@ func TestSplitPath(t *testing.T) {
 		)
 	}
 }
+
+func TestDownloadByIDMD5(t *testing.T) {
+	const content = "hello, world"
+	tc := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, content)
+	})
+
+	sum := md5.Sum([]byte(content))
+	for _, c := range []struct {
+		Label string
+		MD5   string
+		Err   error
+	}{
+		{
+			Label: "no-checksum",
+		},
+		{
+			Label: "match",
+			MD5:   hex.EncodeToString(sum[:]),
+		},
+		{
+			Label: "mismatch",
+			MD5:   "d41d8cd98f00b204e9800998ecf8427e",
+			Err:   ErrMD5Mismatch,
+		},
+	} {
+		t.Run(
+			c.Label,
+			func(t *testing.T) {
+				buf, err := tc.DownloadByID(context.Background(), "id", c.MD5)
+				if err != c.Err {
+					t.Fatalf("DownloadByID expected error %v, got %v", c.Err, err)
+				}
+				if err == nil && buf.String() != content {
+					t.Errorf("DownloadByID expected %q, got %q", content, buf.String())
+				}
+			},
+		)
+	}
+}
+
+func TestFindFileRoot(t *testing.T) {
+	const realID = "0AExampleRootID"
+	tc := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/files/"+RootID) {
+			t.Errorf("Unexpected request path %q", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"id": "`+realID+`"}`)
+	})
+
+	for _, name := range []string{"/", "", "foo/.."} {
+		id, err := tc.FindFile(context.Background(), name, FolderQString)
+		if err != nil {
+			t.Fatalf("FindFile(%q) returned error: %v", name, err)
+		}
+		if id != realID {
+			t.Errorf("FindFile(%q) expected %q, got %q", name, realID, id)
+		}
+	}
+}
+
+func TestResolveFolderByID(t *testing.T) {
+	tc := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		default:
+			http.NotFound(w, r)
+		case "folder":
+			io.WriteString(w, `{"id": "folder", "mimeType": "`+FolderMimeType+`"}`)
+		case "file":
+			io.WriteString(w, `{"id": "file", "mimeType": "text/plain"}`)
+		}
+	})
+
+	for _, c := range []struct {
+		Source   string
+		Expected string
+		Err      bool
+	}{
+		{
+			Source:   "id:folder",
+			Expected: "folder",
+		},
+		{
+			Source: "id:file",
+			Err:    true,
+		},
+		{
+			Source: "id:missing",
+			Err:    true,
+		},
+	} {
+		t.Run(
+			c.Source,
+			func(t *testing.T) {
+				id, err := tc.ResolveFolder(context.Background(), c.Source)
+				if c.Err {
+					if err == nil {
+						t.Errorf("ResolveFolder(%q) expected error, got id %q", c.Source, id)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("ResolveFolder(%q) returned error: %v", c.Source, err)
+				}
+				if id != c.Expected {
+					t.Errorf("ResolveFolder(%q) expected %q, got %q", c.Source, c.Expected, id)
+				}
+			},
+		)
+	}
+}
@@ -34,6 +34,10 @@ type TracedClient struct {
 
 	Logger *zap.SugaredLogger
 
+	// The id of the shared drive to work in.
+	// If empty, My Drive will be used.
+	DriveID string
+
 	id TraceID
 }
 
@@ -60,6 +64,7 @@ func (tc TracedClient) NewChild() TracedClient {
 	return TracedClient{
 		Service: tc.Service,
 		Logger:  tc.Logger.Named(id.String()),
+		DriveID: tc.DriveID,
 		id:      id,
 	}
 }
@@ -0,0 +1,179 @@
+package gfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// ConflictPolicy defines what to do when flushing a file that was changed on
+// Drive after we loaded it.
+type ConflictPolicy string
+
+// Supported ConflictPolicy values.
+const (
+	// Overwrite the changes on Drive with our version.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+
+	// Fail the flush with ConflictErrno, keeping the changes on Drive.
+	ConflictFail ConflictPolicy = "fail"
+
+	// Upload our version as a new file next to the original one,
+	// see ConflictName for the naming.
+	ConflictCopy ConflictPolicy = "copy"
+)
+
+// ConflictErrno is the errno returned by flush with ConflictFail policy.
+const ConflictErrno = syscall.ESTALE
+
+// ConflictName returns the name of the conflict copy for a file.
+//
+// For example, "file.txt" will become "file (conflict 2006-01-02 host).txt".
+func ConflictName(name string, t time.Time, host string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" {
+		// dot files like ".bashrc"
+		base, ext = name, ""
+	}
+	return fmt.Sprintf("%s (conflict %s %s)%s", base, t.Format("2006-01-02"), host, ext)
+}
+
+// fileVersion is the version information of a file's content on Drive.
+type fileVersion struct {
+	revision string
+	md5      string
+	mtime    string
+}
+
+func versionOf(f *drive.File) fileVersion {
+	return fileVersion{
+		revision: f.HeadRevisionId,
+		md5:      f.Md5Checksum,
+		mtime:    f.ModifiedTime,
+	}
+}
+
+func (v fileVersion) String() string {
+	return fmt.Sprintf("revision=%q md5=%q mtime=%q", v.revision, v.md5, v.mtime)
+}
+
+// matches checks whether the two versions are of the same content,
+// using the most accurate information available in both.
+func (v fileVersion) matches(other fileVersion) bool {
+	if v.revision != "" && other.revision != "" {
+		return v.revision == other.revision
+	}
+	if v.md5 != "" && other.md5 != "" {
+		return v.md5 == other.md5
+	}
+	return v.mtime == other.mtime
+}
+
+// checkConflict checks whether the file was changed on Drive since we loaded
+// it, and applies the conflict policy if it was.
+//
+// It returns true if the caller should go ahead and upload the content,
+// and the current version on Drive if it was checked.
+//
+// It must be called with fn.lock held.
+func (fn *fileNode) checkConflict(ctx context.Context) (remote fileVersion, upload bool, errno syscall.Errno) {
+	if fn.base == (fileVersion{}) {
+		return remote, true, 0
+	}
+	f, err := fn.commonNode.tc.NewChild().GetByID(ctx, fn.commonNode.id, fileFields)
+	if err != nil {
+		return remote, false, syscall.EREMOTEIO
+	}
+	remote = versionOf(f)
+	if fn.base.matches(remote) {
+		return remote, true, 0
+	}
+
+	policy := fn.commonNode.opts.ConflictPolicy
+	if policy == "" {
+		policy = ConflictCopy
+	}
+	fn.commonNode.tc.Logger.Warnw(
+		"CONFLICT: file changed on Drive since it was loaded",
+		"id", fn.commonNode.id,
+		"name", f.Name,
+		"base", fn.base.String(),
+		"remote", remote.String(),
+		"policy", policy,
+	)
+	switch policy {
+	default:
+		fn.commonNode.tc.Logger.Errorw(
+			"Unknown conflict policy, failing the flush",
+			"policy", policy,
+		)
+		return remote, false, ConflictErrno
+	case ConflictOverwrite:
+		return remote, true, 0
+	case ConflictFail:
+		return remote, false, ConflictErrno
+	case ConflictCopy:
+		errno = fn.uploadConflictCopy(ctx, f.Name)
+		if errno == 0 {
+			fn.entry = fn.cacheFile(f)
+		}
+		return remote, false, errno
+	}
+}
+
+// uploadConflictCopy uploads the content as a new file next to the original
+// one, and drops the local content so that further reads get the version on
+// Drive.
+//
+// It must be called with fn.lock held.
+func (fn *fileNode) uploadConflictCopy(ctx context.Context, name string) syscall.Errno {
+	_, parent := fn.Parent()
+	if parent == nil {
+		return ConflictErrno
+	}
+	dn, ok := parent.Operations().(*dirNode)
+	if !ok {
+		return ConflictErrno
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	copyName := ConflictName(name, time.Now(), host)
+	f, err := fn.commonNode.tc.NewChild().CreateWithMedia(
+		ctx,
+		copyName,
+		dn.commonNode.id,
+		fileFields,
+		// The metadata changes belong to our version.
+		fn.meta,
+		bytes.NewReader(fn.buffer.Bytes()),
+	)
+	if err != nil {
+		return syscall.EREMOTEIO
+	}
+	fn.meta = nil
+	dn.cacheFile(f)
+	atomic.AddUint64(&globalStats.Uploads, 1)
+	fn.commonNode.tc.Logger.Warnw(
+		"CONFLICT: uploaded local version as conflict copy",
+		"id", fn.commonNode.id,
+		"copyID", f.Id,
+		"copyName", copyName,
+	)
+	fn.buffer = nil
+	fn.hasher = nil
+	fn.copied = nil
+	fn.base = fileVersion{}
+	fn.dirty = false
+	return 0
+}
@@ -0,0 +1,48 @@
+package gfs_test
+
+import (
+	"testing"
+	"time"
+
+	"go.yhsif.com/godrive-fuse/gfs"
+)
+
+func TestConflictName(t *testing.T) {
+	date := time.Date(2026, time.October, 16, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		Name     string
+		Expected string
+	}{
+		{
+			Name:     "file.txt",
+			Expected: "file (conflict 2026-10-16 host).txt",
+		},
+		{
+			Name:     "file",
+			Expected: "file (conflict 2026-10-16 host)",
+		},
+		{
+			Name:     "archive.tar.gz",
+			Expected: "archive.tar (conflict 2026-10-16 host).gz",
+		},
+		{
+			Name:     ".bashrc",
+			Expected: ".bashrc (conflict 2026-10-16 host)",
+		},
+	} {
+		t.Run(
+			c.Name,
+			func(t *testing.T) {
+				name := gfs.ConflictName(c.Name, date, "host")
+				if name != c.Expected {
+					t.Errorf(
+						"ConflictName(%q) expected %q, got %q",
+						c.Name,
+						c.Expected,
+						name,
+					)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,149 @@
+package gfs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// The max number of bytes reported by a single CopyFileRange call.
+//
+// The kernel keeps calling CopyFileRange for the rest of the range,
+// which will be reported as copied without any API calls,
+// as long as the destination is not changed in between.
+const maxCopyReply = 1 << 30
+
+var _ fs.NodeCopyFileRanger = (*fileNode)(nil)
+
+// CopyFileRange implements copy_file_range.
+//
+// Copying a whole file into a newly created file is done with a server side
+// copy on Drive. All other cases return ENOTSUP so that the kernel falls back
+// to normal copying.
+//
+// A call from offset 0 copies the whole file even if its length is shorter,
+// as callers like io.Copy copy large files in chunks, and the following
+// chunks are reported as copied.
+func (fn *fileNode) CopyFileRange(
+	ctx context.Context,
+	fhIn fs.FileHandle,
+	offIn uint64,
+	out *fs.Inode,
+	fhOut fs.FileHandle,
+	offOut uint64,
+	length uint64,
+	flags uint64,
+) (uint32, syscall.Errno) {
+	fn.commonNode.tc.Logger.Debugw(
+		"CopyFileRange called",
+		"id", fn.commonNode.id,
+		"offIn", offIn,
+		"offOut", offOut,
+		"len", length,
+		"flags", flags,
+	)
+
+	if errno := fn.commonNode.checkWritable(); errno != 0 {
+		return 0, errno
+	}
+	dst, ok := out.Operations().(*fileNode)
+	if !ok || dst == fn || flags != 0 || offIn != offOut {
+		return 0, syscall.ENOTSUP
+	}
+
+	fn.lock.Lock()
+	srcID := fn.commonNode.id
+	copyable := fn.parent == nil && !fn.dirty
+	base := fn.base
+	loaded := fn.buffer != nil
+	fn.lock.Unlock()
+	if !copyable {
+		return 0, syscall.ENOTSUP
+	}
+
+	dst.lock.Lock()
+	defer dst.lock.Unlock()
+
+	if offIn > 0 {
+		// The rest of a range we already copied on Drive.
+		c := dst.copied
+		if c == nil || c.from != srcID || offIn != c.end {
+			return 0, syscall.ENOTSUP
+		}
+		n := copyReply(c.size-offIn, length)
+		c.end += uint64(n)
+		return n, 0
+	}
+
+	if dst.parent == nil || dst.buffer.Len() > 0 {
+		return 0, syscall.ENOTSUP
+	}
+	if dst.unlinked {
+		// Already unlinked.
+		return 0, syscall.ENOTSUP
+	}
+	// The cached size could be outdated, check the current version on Drive.
+	tc := dst.commonNode.tc.NewChild()
+	src, err := tc.GetByID(ctx, srcID, fileFields)
+	if err != nil {
+		return 0, syscall.EREMOTEIO
+	}
+	if loaded && !base.matches(versionOf(src)) {
+		// What's read locally is no longer the version on Drive.
+		return 0, syscall.ENOTSUP
+	}
+	f, err := tc.CopyByID(
+		ctx,
+		srcID,
+		dst.entry.name,
+		dst.parent.commonNode.id,
+		fileFields,
+	)
+	if err != nil {
+		return 0, syscall.EREMOTEIO
+	}
+	dst.remoteCreated(f)
+	dst.buffer = nil
+	dst.hasher = nil
+	dst.dirty = false
+	size := uint64(f.Size)
+	n := copyReply(size, length)
+	dst.copied = &copiedRange{
+		from: srcID,
+		size: size,
+		end:  uint64(n),
+	}
+	dst.commonNode.tc.Logger.Infow(
+		"Copied on Drive",
+		"from", srcID,
+		"to", f.Id,
+		"size", size,
+	)
+	// Metadata changes made before the copy, e.g. chmod.
+	if errno := dst.updateMeta(ctx); errno != 0 {
+		return 0, errno
+	}
+	return n, 0
+}
+
+// copiedRange records a server side copy done by CopyFileRange,
+// so that the following calls for the rest of the range can be verified.
+type copiedRange struct {
+	// The id of the source file.
+	from string
+	// The size of the copied file.
+	size uint64
+	// The end of the range reported as copied so far.
+	end uint64
+}
+
+func copyReply(remaining, length uint64) uint32 {
+	if remaining > length {
+		remaining = length
+	}
+	if remaining > maxCopyReply {
+		remaining = maxCopyReply
+	}
+	return uint32(remaining)
+}
@@ -0,0 +1,193 @@
+package gfs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestCopyFileRange(t *testing.T) {
+	ctx := context.Background()
+	const content = "hello, world"
+	size := uint64(len(content))
+
+	// setup returns the source file and a newly created destination file.
+	setup := func(t *testing.T) (*fakeDrive, string, *fileNode, *fileNode) {
+		fd := newFakeDrive(t)
+		id := fd.add(&drive.File{Name: "src"}, []byte(content))
+		root := fd.mount(Options{}, MountOptions{})
+		src := lookup(t, root, "src").(*fileNode)
+		dst := create(t, root, "dst")
+		return fd, id, src, dst
+	}
+	copyRange := func(src, dst *fileNode, off, length uint64) (uint32, syscall.Errno) {
+		return src.CopyFileRange(ctx, nil, off, dst.EmbeddedInode(), nil, off, length, 0)
+	}
+
+	t.Run("whole", func(t *testing.T) {
+		fd, _, src, dst := setup(t)
+		n, errno := copyRange(src, dst, 0, 1<<20)
+		if errno != 0 {
+			t.Fatalf("CopyFileRange failed: %v", errno)
+		}
+		if uint64(n) != size {
+			t.Errorf("CopyFileRange expected %d, got %d", size, n)
+		}
+		if c := fd.count("POST files"); c != 1 {
+			t.Errorf("Expected 1 copy on Drive, got %d", c)
+		}
+		if c := fd.count("POST upload"); c != 0 {
+			t.Errorf("Expected no uploads, got %d", c)
+		}
+		// The kernel asks for the rest of the range.
+		n, errno = copyRange(src, dst, size, 1<<20-size)
+		if errno != 0 || n != 0 {
+			t.Errorf("CopyFileRange at the end expected 0, got %d, %v", n, errno)
+		}
+		f := fd.find(fd.rootID, "dst")
+		if f == nil {
+			t.Fatal("Copy not found on Drive")
+		}
+		if got := fd.content(f.Id); got != content {
+			t.Errorf("Expected copied content %q, got %q", content, got)
+		}
+	})
+
+	t.Run("split", func(t *testing.T) {
+		_, _, src, dst := setup(t)
+		// A range larger than the file, reported in multiple calls.
+		saved := dst.copied
+		n, errno := copyRange(src, dst, 0, 1<<20)
+		if errno != 0 || uint64(n) != size {
+			t.Fatalf("CopyFileRange expected %d, got %d, %v", size, n, errno)
+		}
+		if dst.copied == saved || dst.copied.end != size {
+			t.Fatalf("Copied range not recorded: %+v", dst.copied)
+		}
+		// Not continuing from where the last call ended.
+		if _, errno := copyRange(src, dst, 5, 1<<20); errno != syscall.ENOTSUP {
+			t.Errorf("CopyFileRange from the middle expected ENOTSUP, got %v", errno)
+		}
+	})
+
+	for _, c := range []struct {
+		Label  string
+		Off    uint64
+		Length uint64
+	}{
+		{
+			Label:  "offset",
+			Off:    1,
+			Length: size - 1,
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			fd, _, src, dst := setup(t)
+			if _, errno := copyRange(src, dst, c.Off, c.Length); errno != syscall.ENOTSUP {
+				t.Errorf("CopyFileRange expected ENOTSUP, got %v", errno)
+			}
+			if n := fd.count("POST files"); n != 0 {
+				t.Errorf("Expected no copies on Drive, got %d", n)
+			}
+		})
+	}
+
+	t.Run("dirty-source", func(t *testing.T) {
+		fd, _, src, dst := setup(t)
+		write(t, src, "HELLO", 0)
+		if _, errno := copyRange(src, dst, 0, 1<<20); errno != syscall.ENOTSUP {
+			t.Errorf("CopyFileRange from dirty source expected ENOTSUP, got %v", errno)
+		}
+		if n := fd.count("POST files"); n != 0 {
+			t.Errorf("Expected no copies on Drive, got %d", n)
+		}
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		fd, _, src, dst := setup(t)
+		// Copied in chunks shorter than the file, like io.Copy does.
+		var copied uint64
+		for _, chunk := range []uint64{5, 5, 5} {
+			n, errno := copyRange(src, dst, copied, chunk)
+			if errno != 0 {
+				t.Fatalf("CopyFileRange at %d failed: %v", copied, errno)
+			}
+			copied += uint64(n)
+		}
+		if copied != size {
+			t.Errorf("Expected %d bytes copied, got %d", size, copied)
+		}
+		if n := fd.count("POST files"); n != 1 {
+			t.Errorf("Expected 1 copy on Drive, got %d", n)
+		}
+		f := fd.find(fd.rootID, "dst")
+		if f == nil {
+			t.Fatal("Copy not found on Drive")
+		}
+		if got := fd.content(f.Id); got != content {
+			t.Errorf("Expected copied content %q, got %q", content, got)
+		}
+	})
+
+	t.Run("outdated-size", func(t *testing.T) {
+		fd, id, src, dst := setup(t)
+		// The source grew on Drive after we cached its size.
+		fd.modify(id, []byte(content+content))
+		n, errno := copyRange(src, dst, 0, size)
+		if errno != 0 || uint64(n) != size {
+			t.Fatalf("CopyFileRange expected %d, got %d, %v", size, n, errno)
+		}
+		// The rest of the current version on Drive.
+		n, errno = copyRange(src, dst, size, 1<<20)
+		if errno != 0 || uint64(n) != size {
+			t.Errorf("CopyFileRange for the rest expected %d, got %d, %v", size, n, errno)
+		}
+		f := fd.find(fd.rootID, "dst")
+		if f == nil {
+			t.Fatal("Copy not found on Drive")
+		}
+		if got := fd.content(f.Id); got != content+content {
+			t.Errorf("Expected copied content %q, got %q", content+content, got)
+		}
+	})
+
+	t.Run("pending-meta", func(t *testing.T) {
+		fd, _, src, dst := setup(t)
+		mode := uint32(0600)
+		mtime := uint64(1234567890)
+		if _, errno := setattr(t, dst, &mode, &mtime); errno != 0 {
+			t.Fatalf("Setattr failed: %v", errno)
+		}
+		if _, errno := copyRange(src, dst, 0, 1<<20); errno != 0 {
+			t.Fatalf("CopyFileRange failed: %v", errno)
+		}
+		f := fd.find(fd.rootID, "dst")
+		if f == nil {
+			t.Fatal("Copy not found on Drive")
+		}
+		if got := f.AppProperties[PosixModeKey]; got != "600" {
+			t.Errorf("Expected %s %q, got %q", PosixModeKey, "600", got)
+		}
+		if want := "2009-02-13T23:31:30Z"; f.ModifiedTime != want {
+			t.Errorf("Expected mtime %q, got %q", want, f.ModifiedTime)
+		}
+		if dst.meta != nil {
+			t.Errorf("Expected no pending metadata left, got %+v", dst.meta)
+		}
+	})
+
+	t.Run("modified-destination", func(t *testing.T) {
+		_, _, src, dst := setup(t)
+		n, errno := copyRange(src, dst, 0, 1<<20)
+		if errno != 0 || uint64(n) != size {
+			t.Fatalf("CopyFileRange expected %d, got %d, %v", size, n, errno)
+		}
+		write(t, dst, "changed", 0)
+		// Must not be reported as copied without copying anything.
+		if _, errno := copyRange(src, dst, 7, 5); errno != syscall.ENOTSUP {
+			t.Errorf("CopyFileRange after changes expected ENOTSUP, got %v", errno)
+		}
+	})
+}
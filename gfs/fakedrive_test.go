@@ -0,0 +1,436 @@
+package gfs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"go.uber.org/zap"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+
+	"go.yhsif.com/godrive-fuse/gdrive"
+)
+
+// fakeDriveCount makes the ids from different fakeDrives unique,
+// as globalFilesCache is shared by all of them.
+var fakeDriveCount uint64
+
+// fakeDrive is an in-memory Drive API server,
+// implementing just enough for the calls made by gfs.
+type fakeDrive struct {
+	t      *testing.T
+	server *httptest.Server
+	prefix string
+
+	// The id of the root folder.
+	rootID string
+
+	lock     sync.Mutex
+	nextID   int
+	files    map[string]*drive.File
+	contents map[string][]byte
+	quota    drive.AboutStorageQuota
+
+	// The number of requests, keyed by "METHOD kind",
+	// e.g. "POST upload", "PATCH files" and "GET media".
+	calls map[string]int
+
+	// If non-nil, it's called before handling every request,
+	// and the request is not handled further if it returns true.
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+}
+
+func newFakeDrive(t *testing.T) *fakeDrive {
+	t.Helper()
+	fd := &fakeDrive{
+		t:        t,
+		prefix:   fmt.Sprintf("fake%d-", atomic.AddUint64(&fakeDriveCount, 1)),
+		files:    make(map[string]*drive.File),
+		contents: make(map[string][]byte),
+		calls:    make(map[string]int),
+	}
+	fd.rootID = fd.prefix + "root"
+	fd.files[fd.rootID] = &drive.File{
+		Id:           fd.rootID,
+		Name:         "My Drive",
+		MimeType:     gdrive.FolderMimeType,
+		ModifiedTime: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	fd.server = httptest.NewServer(http.HandlerFunc(fd.serveHTTP))
+	t.Cleanup(fd.server.Close)
+	return fd
+}
+
+// client returns a TracedClient using the fake server.
+func (fd *fakeDrive) client() gdrive.TracedClient {
+	fd.t.Helper()
+	srv, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(fd.server.URL+"/"),
+		option.WithHTTPClient(fd.server.Client()),
+	)
+	if err != nil {
+		fd.t.Fatal(err)
+	}
+	return gdrive.NewTracedClient(srv, zap.NewNop().Sugar())
+}
+
+// mount returns the root node of a mount of the fake root folder,
+// attached to a node tree without an actual fuse mount.
+func (fd *fakeDrive) mount(opts Options, mo MountOptions) *dirNode {
+	fd.t.Helper()
+	if err := opts.init(); err != nil {
+		fd.t.Fatal(err)
+	}
+	scopes := scopesOf(mo.Scopes)
+	opts.scopes = &scopes
+	opts.mount = mo
+	root := &dirNode{
+		commonNode: commonNode{
+			id:   fd.rootID,
+			tc:   fd.client(),
+			opts: &opts,
+		},
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	return root
+}
+
+// add adds a file with content to the fake drive, and returns its id.
+func (fd *fakeDrive) add(f *drive.File, content []byte) string {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	fd.nextID++
+	f.Id = fmt.Sprintf("%s%d", fd.prefix, fd.nextID)
+	if len(f.Parents) == 0 {
+		f.Parents = []string{fd.rootID}
+	}
+	if f.ModifiedTime == "" {
+		f.ModifiedTime = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	fd.files[f.Id] = f
+	if f.MimeType != gdrive.FolderMimeType {
+		fd.setContent(f, content)
+	}
+	return f.Id
+}
+
+// modify replaces the content of the file with id, like changes made by
+// others on Drive.
+func (fd *fakeDrive) modify(id string, content []byte) {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	f := fd.files[id]
+	fd.setContent(f, content)
+	f.ModifiedTime = time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// setContent replaces the content of f, as a new revision.
+//
+// It must be called with fd.lock held.
+func (fd *fakeDrive) setContent(f *drive.File, content []byte) {
+	fd.contents[f.Id] = content
+	sum := md5.Sum(content)
+	f.Md5Checksum = hex.EncodeToString(sum[:])
+	f.Size = int64(len(content))
+	fd.nextID++
+	f.HeadRevisionId = fmt.Sprintf("rev%d", fd.nextID)
+}
+
+// get returns a copy of the file with id, or nil if it doesn't exist.
+func (fd *fakeDrive) get(id string) *drive.File {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	f, ok := fd.files[id]
+	if !ok {
+		return nil
+	}
+	copied := *f
+	return &copied
+}
+
+// content returns the content of the file with id.
+func (fd *fakeDrive) content(id string) string {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	return string(fd.contents[id])
+}
+
+// find returns a copy of the file with name under parentID,
+// or nil if it doesn't exist.
+func (fd *fakeDrive) find(parentID, name string) *drive.File {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	for _, f := range fd.files {
+		if f.Name == name && !f.Trashed && hasParent(f, parentID) {
+			copied := *f
+			return &copied
+		}
+	}
+	return nil
+}
+
+// children returns copies of the files under parentID.
+func (fd *fakeDrive) children(parentID string) []*drive.File {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	var files []*drive.File
+	for _, f := range fd.files {
+		if !f.Trashed && hasParent(f, parentID) {
+			copied := *f
+			files = append(files, &copied)
+		}
+	}
+	return files
+}
+
+// count returns the number of requests of key, e.g. "POST upload".
+func (fd *fakeDrive) count(key string) int {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	return fd.calls[key]
+}
+
+func hasParent(f *drive.File, parentID string) bool {
+	for _, p := range f.Parents {
+		if p == parentID {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	qParentRE = regexp.MustCompile(`'([^']*)' in parents`)
+	qNameRE   = regexp.MustCompile(`name = '([^']*)'`)
+)
+
+func (fd *fakeDrive) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if fd.intercept != nil && fd.intercept(w, r) {
+		return
+	}
+
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	kind := "files"
+	if strings.HasPrefix(path, "upload/drive/v3/") {
+		kind = "upload"
+		path = strings.TrimPrefix(path, "upload/drive/v3/")
+	}
+	if r.URL.Query().Get("alt") == "media" {
+		kind = "media"
+	}
+	if path == "about" {
+		kind = "about"
+	}
+	fd.calls[r.Method+" "+kind]++
+
+	parts := strings.Split(path, "/")
+	switch {
+	default:
+		fd.t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+
+	case kind == "about":
+		writeJSON(w, &drive.About{StorageQuota: &fd.quota})
+
+	case r.Method == http.MethodGet && len(parts) == 1:
+		q := r.URL.Query().Get("q")
+		var parent, name string
+		if m := qParentRE.FindStringSubmatch(q); m != nil {
+			parent = m[1]
+		}
+		if m := qNameRE.FindStringSubmatch(q); m != nil {
+			name = m[1]
+		}
+		list := &drive.FileList{Files: []*drive.File{}}
+		for _, f := range fd.files {
+			if f.Trashed || !hasParent(f, parent) || (name != "" && f.Name != name) {
+				continue
+			}
+			list.Files = append(list.Files, f)
+		}
+		writeJSON(w, list)
+
+	case r.Method == http.MethodGet && len(parts) == 2:
+		f, ok := fd.files[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if kind == "media" {
+			w.Write(fd.contents[f.Id])
+			return
+		}
+		writeJSON(w, f)
+
+	case r.Method == http.MethodPost && len(parts) == 1:
+		meta, content := fd.readBody(r)
+		f := new(drive.File)
+		if err := json.Unmarshal(meta, f); err != nil {
+			fd.t.Errorf("Unable to decode create request: %v", err)
+		}
+		fd.nextID++
+		f.Id = fmt.Sprintf("%s%d", fd.prefix, fd.nextID)
+		if f.ModifiedTime == "" {
+			f.ModifiedTime = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		fd.files[f.Id] = f
+		if f.MimeType != gdrive.FolderMimeType {
+			fd.setContent(f, content)
+		}
+		writeJSON(w, f)
+
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "copy":
+		src, ok := fd.files[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		meta, _ := fd.readBody(r)
+		f := new(drive.File)
+		if err := json.Unmarshal(meta, f); err != nil {
+			fd.t.Errorf("Unable to decode copy request: %v", err)
+		}
+		fd.nextID++
+		f.Id = fmt.Sprintf("%s%d", fd.prefix, fd.nextID)
+		f.MimeType = src.MimeType
+		f.ModifiedTime = time.Now().UTC().Format(time.RFC3339Nano)
+		fd.files[f.Id] = f
+		fd.setContent(f, fd.contents[src.Id])
+		writeJSON(w, f)
+
+	case r.Method == http.MethodPatch && len(parts) == 2:
+		f, ok := fd.files[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		meta, content := fd.readBody(r)
+		fd.update(f, meta)
+		if remove := r.URL.Query().Get("removeParents"); remove != "" {
+			var parents []string
+			for _, p := range f.Parents {
+				if p != remove {
+					parents = append(parents, p)
+				}
+			}
+			f.Parents = parents
+		}
+		if kind == "upload" {
+			fd.setContent(f, content)
+		}
+		writeJSON(w, f)
+
+	case r.Method == http.MethodDelete && len(parts) == 2:
+		delete(fd.files, parts[1])
+		delete(fd.contents, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// readBody reads the metadata and the optional media content of the request.
+func (fd *fakeDrive) readBody(r *http.Request) (meta []byte, content []byte) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		meta, _ = ioutil.ReadAll(r.Body)
+		return meta, nil
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fd.t.Errorf("Unable to read multipart request: %v", err)
+			return
+		}
+		data, _ := ioutil.ReadAll(part)
+		if i == 0 {
+			meta = data
+		} else {
+			content = data
+		}
+	}
+}
+
+// update applies the metadata changes in body to f.
+//
+// It must be called with fd.lock held.
+func (fd *fakeDrive) update(f *drive.File, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		fd.t.Errorf("Unable to decode update request %q: %v", body, err)
+		return
+	}
+	for name, value := range fields {
+		var err error
+		switch name {
+		default:
+			fd.t.Errorf("Unexpected field %q in update request", name)
+		case "name":
+			err = json.Unmarshal(value, &f.Name)
+		case "description":
+			err = json.Unmarshal(value, &f.Description)
+		case "starred":
+			err = json.Unmarshal(value, &f.Starred)
+		case "trashed":
+			err = json.Unmarshal(value, &f.Trashed)
+		case "modifiedTime":
+			err = json.Unmarshal(value, &f.ModifiedTime)
+		case "appProperties":
+			f.AppProperties, err = mergeProperties(f.AppProperties, value)
+		case "properties":
+			f.Properties, err = mergeProperties(f.Properties, value)
+		}
+		if err != nil {
+			fd.t.Errorf("Unable to decode field %q in update request: %v", name, err)
+		}
+	}
+}
+
+// mergeProperties merges the changes into props, null values delete the keys.
+func mergeProperties(props map[string]string, changes []byte) (map[string]string, error) {
+	var values map[string]*string
+	if err := json.Unmarshal(changes, &values); err != nil {
+		return props, err
+	}
+	if props == nil {
+		props = make(map[string]string)
+	}
+	for k, v := range values {
+		if v == nil {
+			delete(props, k)
+		} else {
+			props[k] = *v
+		}
+	}
+	return props, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
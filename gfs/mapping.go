@@ -1,7 +1,18 @@
 package gfs
 
 import (
+	"bufio"
+	"fmt"
 	"hash/crc64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/reddit/baseplate.go/log"
 )
 
 var table = crc64.MakeTable(crc64.ECMA)
@@ -9,6 +20,343 @@ var table = crc64.MakeTable(crc64.ECMA)
 // IDtoInode maps a Drive id into an inode.
 //
 // It uses CRC64 ECMA table to do the mapping.
+//
+// It's not guaranteed to be unique, use InodeMap instead.
+// InodeMap uses it as the preferred inode for an id.
 func IDtoInode(id string) uint64 {
 	return crc64.Checksum([]byte(id), table)
 }
+
+// The first inode number InodeMap could allocate.
+// Inode 0 is invalid and 1 is used by the mount root.
+const firstInode = 2
+
+// InodeMapCompactLines is the min number of lines in the file backing an
+// InodeMap before it's compacted while mounted.
+//
+// It's always compacted when loaded, and while mounted it's only compacted
+// when more than half of the lines are stale.
+const InodeMapCompactLines = 4096
+
+// InodeMap allocates unique inode numbers for Drive ids.
+//
+// Inodes released by Forget are not reused until the map is loaded again,
+// so allocated inodes are never reused while mounted.
+// If a path is given to NewInodeMap,
+// the allocations are persisted to it and stay stable across restarts,
+// with a new generation on every load to tell reused inodes apart.
+type InodeMap struct {
+	lock   sync.Mutex
+	gen    uint64
+	inodes map[string]uint64
+	// Released inodes are kept with an empty id.
+	ids map[uint64]string
+
+	path string
+	file *os.File
+	// The lock file held while the map is open,
+	// so that other processes don't interleave their writes with ours.
+	lockFile *os.File
+	// The number of lines in file.
+	lines int
+}
+
+// NewInodeMap creates a new InodeMap.
+//
+// If path is non-empty, existing allocations are loaded from it,
+// and new allocations are appended to it.
+// The generation stored in the file is bumped,
+// or a new one is started if the file does not exist yet.
+//
+// The file is locked until Close is called.
+// If it's already used by another process,
+// the returned map is only kept in memory.
+func NewInodeMap(path string) (*InodeMap, error) {
+	m := &InodeMap{
+		inodes: make(map[string]uint64),
+		ids:    make(map[uint64]string),
+		path:   path,
+	}
+	if path == "" {
+		m.gen = 1
+		return m, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lockFile.Close()
+		if err == syscall.EWOULDBLOCK {
+			log.Warnw(
+				"Inode file is used by another process, inodes will not persist across restarts; set a different fs.inode_file for it",
+				"file", path,
+			)
+			m.path = ""
+			m.gen = 1
+			return m, nil
+		}
+		return nil, fmt.Errorf("unable to lock inode file %s: %w", path, err)
+	}
+	m.lockFile = lockFile
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.file = f
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m.lines++
+		m.parseLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	if m.gen == 0 {
+		// New file, or we lost the generation: start a new one,
+		// so that inodes from previous generations are considered stale.
+		m.gen = uint64(time.Now().Unix())
+	} else {
+		// Inodes released before are free to be reused from now on.
+		m.gen++
+	}
+	// Also persists the new generation.
+	if err := m.compact(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// encodeID encodes id to be written as the last field of a line.
+//
+// Ids of pending files contain file names, which are quoted if they could
+// break the line format.
+func encodeID(id string) string {
+	if id == "" || strings.ContainsAny(id, " \t\"\\") || !strconv.CanBackquote(id) {
+		return strconv.Quote(id)
+	}
+	return id
+}
+
+// decodeID decodes id encoded by encodeID.
+func decodeID(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		return strconv.Unquote(s)
+	}
+	return s, nil
+}
+
+func (m *InodeMap) parseLine(line string) {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		log.Warnw("Skipping malformed inode map line", "line", line)
+		return
+	}
+	if parts[0] != "gen" {
+		id, err := decodeID(parts[1])
+		if err != nil {
+			log.Warnw("Skipping malformed inode map line", "line", line, "err", err)
+			return
+		}
+		parts[1] = id
+	}
+	switch parts[0] {
+	case "gen":
+		n, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			log.Warnw("Skipping malformed inode map line", "line", line, "err", err)
+			return
+		}
+		m.gen = n
+		return
+	case "forget":
+		if ino, ok := m.inodes[parts[1]]; ok {
+			delete(m.inodes, parts[1])
+			delete(m.ids, ino)
+		}
+		return
+	}
+	ino, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || ino < firstInode {
+		log.Warnw("Skipping malformed inode map line", "line", line, "err", err)
+		return
+	}
+	m.set(parts[1], ino)
+}
+
+// set maps id to ino, overriding previous mappings of both.
+//
+// It must be called with m.lock held.
+func (m *InodeMap) set(id string, ino uint64) {
+	if old, ok := m.ids[ino]; ok {
+		delete(m.inodes, old)
+	}
+	if old, ok := m.inodes[id]; ok {
+		delete(m.ids, old)
+	}
+	m.inodes[id] = ino
+	m.ids[ino] = id
+}
+
+// write appends a line to the backing file, if any,
+// and compacts it when there are too many stale lines.
+//
+// It must be called with m.lock held.
+func (m *InodeMap) write(format string, args ...interface{}) {
+	if m.file == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(m.file, format, args...); err != nil {
+		log.Errorw("Unable to write inode map", "file", m.path, "err", err)
+		return
+	}
+	m.lines++
+	if m.lines >= InodeMapCompactLines && m.lines > 2*(len(m.inodes)+1) {
+		if err := m.compact(); err != nil {
+			log.Errorw("Unable to compact inode map", "file", m.path, "err", err)
+		}
+	}
+}
+
+// compact rewrites the backing file with only the current allocations.
+//
+// The new content is written into a temporary file first,
+// then renamed to replace the backing file.
+//
+// It must be called with m.lock held.
+func (m *InodeMap) compact() (err error) {
+	tmp := m.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "gen %d\n", m.gen)
+	for id, ino := range m.inodes {
+		fmt.Fprintf(w, "%d %s\n", ino, encodeID(id))
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, m.path); err != nil {
+		return err
+	}
+
+	m.file.Close()
+	m.file, err = os.OpenFile(m.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		m.file = nil
+		return err
+	}
+	m.lines = len(m.inodes) + 1
+	return nil
+}
+
+// Gen returns the generation of the inodes allocated.
+//
+// It only changes when the map is loaded again,
+// as inodes are never reused while mounted.
+func (m *InodeMap) Gen() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.gen
+}
+
+// Inode returns the inode allocated to id, allocating a new one if needed.
+func (m *InodeMap) Inode(id string) uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if ino, ok := m.inodes[id]; ok {
+		return ino
+	}
+	ino := IDtoInode(id)
+	for {
+		if ino < firstInode {
+			ino = firstInode
+		}
+		if _, taken := m.ids[ino]; !taken {
+			break
+		}
+		// Collision, probe the next one.
+		ino++
+	}
+	m.set(id, ino)
+	m.write("%d %s\n", ino, encodeID(id))
+	return ino
+}
+
+// Move moves the inode allocated to from to id to, if any.
+//
+// It's used when a locally created file gets its real id from Drive.
+func (m *InodeMap) Move(from, to string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ino, ok := m.inodes[from]
+	if !ok || from == to {
+		return
+	}
+	m.set(to, ino)
+	m.write("%d %s\n", ino, encodeID(to))
+}
+
+// Forget releases the inode allocated to id, if any.
+//
+// It's used when a file is deleted, or a locally created file is unlinked
+// before it's created on Drive.
+// The inode is not reused until the map is loaded again,
+// as the kernel could still be using it.
+func (m *InodeMap) Forget(id string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ino, ok := m.inodes[id]
+	if !ok {
+		return
+	}
+	delete(m.inodes, id)
+	m.ids[ino] = ""
+	m.write("forget %s\n", encodeID(id))
+}
+
+// Close closes the backing file, if any.
+func (m *InodeMap) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var err error
+	if m.file != nil {
+		err = m.file.Close()
+		m.file = nil
+	}
+	if m.lockFile != nil {
+		// Closing it also releases the lock.
+		if lockErr := m.lockFile.Close(); err == nil {
+			err = lockErr
+		}
+		m.lockFile = nil
+	}
+	return err
+}
@@ -1,33 +1,40 @@
 package gfs_test
 
 import (
+	"fmt"
 	"hash/crc64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/reddit/baseplate.go/randbp"
 
 	"go.yhsif.com/godrive-fuse/gdrive"
+	"go.yhsif.com/godrive-fuse/gfs"
 )
 
+var benchmarkIDs = []string{
+	gdrive.RootID,
+	"1-3pxPSAQG8Sk9GJigM8E1M24VtV1ilhZ",
+	"1ptgtbuoGn_ypmSBIN5eqncvxGZrgKVhA",
+	"1bzXmbfRhainTOHryPfWKGrlvqFLD8_vw",
+	"1kGxb29wbSiSshUSS92iv5flzyaEG9hJm",
+}
+
 func BenchmarkCRC64(b *testing.B) {
 	tables := map[string]*crc64.Table{
 		"ISO":  crc64.MakeTable(crc64.ISO),
 		"ECMA": crc64.MakeTable(crc64.ECMA),
 	}
-	ids := []string{
-		gdrive.RootID,
-		"1-3pxPSAQG8Sk9GJigM8E1M24VtV1ilhZ",
-		"1ptgtbuoGn_ypmSBIN5eqncvxGZrgKVhA",
-		"1bzXmbfRhainTOHryPfWKGrlvqFLD8_vw",
-		"1kGxb29wbSiSshUSS92iv5flzyaEG9hJm",
-	}
 	for label, table := range tables {
 		b.Run(
 			label,
 			func(b *testing.B) {
 				b.RunParallel(func(pb *testing.PB) {
 					for pb.Next() {
-						id := ids[randbp.R.Intn(len(ids))]
+						id := benchmarkIDs[randbp.R.Intn(len(benchmarkIDs))]
 						crc64.Checksum([]byte(id), table)
 					}
 				})
@@ -35,3 +42,219 @@ func BenchmarkCRC64(b *testing.B) {
 		)
 	}
 }
+
+func BenchmarkInodeMap(b *testing.B) {
+	m, err := gfs.NewInodeMap("")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run(
+		"existing",
+		func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					m.Inode(benchmarkIDs[randbp.R.Intn(len(benchmarkIDs))])
+				}
+			})
+		},
+	)
+	b.Run(
+		"new",
+		func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					m.Inode(fmt.Sprintf("%016x", randbp.R.Uint64()))
+				}
+			})
+		},
+	)
+}
+
+func TestInodeMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inodes.map")
+
+	const (
+		collideWith = "collide-with"
+		pending     = "parent/pending file"
+		created     = "created"
+		quoted      = "parent/\"new\nline\" \\"
+	)
+	// Seed the file with a different id taking the preferred inode of an id.
+	seed := fmt.Sprintf(
+		"gen 42\n%d %s\n",
+		gfs.IDtoInode(benchmarkIDs[1]),
+		collideWith,
+	)
+	if err := ioutil.WriteFile(path, []byte(seed), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := gfs.NewInodeMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen := m.Gen(); gen != 43 {
+		t.Errorf("Expected gen 43, got %d", gen)
+	}
+	inodes := make(map[string]uint64)
+	seen := make(map[uint64]string)
+	for _, id := range append(benchmarkIDs, collideWith, pending, quoted) {
+		ino := m.Inode(id)
+		if ino < 2 {
+			t.Errorf("Inode(%q) returned reserved inode %d", id, ino)
+		}
+		if other, ok := seen[ino]; ok {
+			t.Errorf("Inode(%q) returned %d, which is already used by %q", id, ino, other)
+		}
+		seen[ino] = id
+		inodes[id] = ino
+	}
+	m.Move(pending, created)
+	inodes[created] = inodes[pending]
+	delete(inodes, pending)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = gfs.NewInodeMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if gen := m.Gen(); gen != 44 {
+		t.Errorf("Expected gen 44 after reload, got %d", gen)
+	}
+	for id, expected := range inodes {
+		if ino := m.Inode(id); ino != expected {
+			t.Errorf("Inode(%q) after reload expected %d, got %d", id, expected, ino)
+		}
+	}
+	if ino := m.Inode(pending); ino == inodes[created] {
+		t.Errorf("Inode(%q) after Move expected a new inode, got %d", pending, ino)
+	}
+}
+
+// countLines returns the number of lines in the file at path.
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(content), "\n")
+}
+
+func TestInodeMapForget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inodes.map")
+
+	const (
+		collideWith = "collide-with"
+		forgotten   = "forgotten"
+	)
+	id := benchmarkIDs[1]
+	preferred := gfs.IDtoInode(id)
+	// Stale lines from moves and the id taking the preferred inode of another.
+	seed := fmt.Sprintf(
+		"gen 42\n%d %s\n%d pending\n%d %s\n",
+		preferred,
+		collideWith,
+		preferred+5,
+		preferred+5,
+		forgotten,
+	)
+	if err := ioutil.WriteFile(path, []byte(seed), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := gfs.NewInodeMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, path); n != 3 {
+		t.Errorf("Expected 3 lines after compacting on load, got %d", n)
+	}
+
+	// Used by another map, falls back to memory only.
+	other, err := gfs.NewInodeMap(path)
+	if err != nil {
+		t.Fatalf("Expected in memory map for the inode file used by another map, got %v", err)
+	}
+	other.Inode("other")
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, path); n != 3 {
+		t.Errorf("Expected no writes from the other map, got %d lines", n)
+	}
+
+	old := m.Inode(id)
+	if old != preferred+1 {
+		t.Fatalf("Inode(%q) expected %d, got %d", id, preferred+1, old)
+	}
+	m.Forget(collideWith)
+	m.Forget(id)
+	m.Forget(forgotten)
+	// Released inodes are not reused while it's still open.
+	if ino := m.Inode(id); ino == preferred || ino == old {
+		t.Errorf("Inode(%q) reused released inode %d", id, ino)
+	}
+	m.Forget(id)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = gfs.NewInodeMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	// Reused inodes must not match handles from before.
+	if gen := m.Gen(); gen != 44 {
+		t.Errorf("Expected gen 44 after reload, got %d", gen)
+	}
+	if n := countLines(t, path); n != 1 {
+		t.Errorf("Expected only the gen line after forgetting everything, got %d lines", n)
+	}
+	// Released inodes are available after reload.
+	if ino := m.Inode(id); ino != preferred {
+		t.Errorf("Inode(%q) after reload expected %d, got %d", id, preferred, ino)
+	}
+}
+
+func TestInodeMapCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inodes.map")
+
+	m, err := gfs.NewInodeMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	kept := m.Inode(benchmarkIDs[1])
+	for i := 0; i < gfs.InodeMapCompactLines; i++ {
+		pending := fmt.Sprintf("parent/file%d", i)
+		m.Inode(pending)
+		m.Move(pending, fmt.Sprintf("created%d", i))
+		m.Forget(fmt.Sprintf("created%d", i))
+	}
+	if n := countLines(t, path); n >= gfs.InodeMapCompactLines {
+		t.Errorf("Expected the file to be compacted, got %d lines", n)
+	}
+	if ino := m.Inode(benchmarkIDs[1]); ino != kept {
+		t.Errorf("Inode(%q) after compaction expected %d, got %d", benchmarkIDs[1], kept, ino)
+	}
+}
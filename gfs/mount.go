@@ -15,9 +15,51 @@ import (
 	"go.yhsif.com/godrive-fuse/gdrive"
 )
 
-// Mountpoints defines a mapping from local mount directory to Drive directory
-// name.
-type Mountpoints map[string]string
+// Mountpoints defines a mapping from local mount directory to its options.
+type Mountpoints map[string]MountOptions
+
+// Options defines the options shared by all mountpoints.
+type Options struct {
+	// The policy used when a file was changed on Drive after we loaded it.
+	// Default is ConflictCopy.
+	ConflictPolicy ConflictPolicy `yaml:"conflict_policy"`
+
+	// How to map Drive owners to local users and groups.
+	Owners OwnerMapping `yaml:"owners"`
+
+	// The file to persist allocated inode numbers,
+	// so that they stay stable across restarts.
+	// If empty, inode numbers are only kept in memory.
+	InodeFile string `yaml:"inode_file"`
+
+	owners *ownerMap
+	inodes *InodeMap
+	scopes *scopeSet
+	mount  MountOptions
+}
+
+// init initializes the unexported fields of opts.
+func (opts *Options) init() error {
+	if opts.owners == nil {
+		opts.owners = opts.Owners.resolve()
+	}
+	if opts.inodes == nil {
+		inodes, err := NewInodeMap(os.ExpandEnv(opts.InodeFile))
+		if err != nil {
+			return err
+		}
+		opts.inodes = inodes
+	}
+	return nil
+}
+
+// Client is an authorized Drive client of a profile.
+type Client struct {
+	Service *drive.Service
+
+	// The OAuth scopes granted to the client.
+	Scopes []string
+}
 
 // Mountpoint defines a single mountpoint.
 type Mountpoint struct {
@@ -27,24 +69,57 @@ type Mountpoint struct {
 }
 
 // Mount mounts the fs.
-func Mount(tc gdrive.TracedClient, rootID string, to string) (*Mountpoint, error) {
+//
+// opts are shared by all mountpoints, and mo is for this mountpoint only.
+func Mount(tc gdrive.TracedClient, rootID string, to string, opts Options, mo MountOptions) (*Mountpoint, error) {
+	if err := mo.validate(); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(to, 0755); err != nil {
 		return nil, err
 	}
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	scopes := scopesOf(mo.Scopes)
+	opts.scopes = &scopes
+	if !opts.scopes.write && !mo.ReadOnly {
+		tc.Logger.Infow(
+			"Granted OAuth scopes don't allow changes, mounting read-only",
+			"scopes", mo.Scopes,
+		)
+		mo.ReadOnly = true
+	}
+	if !opts.scopes.content {
+		tc.Logger.Warnw(
+			"Granted OAuth scopes don't allow downloading file contents, reading files will fail",
+			"scopes", mo.Scopes,
+		)
+	}
+	if !opts.scopes.all {
+		tc.Logger.Warnw(
+			"Granted OAuth scopes only allow files created by this app, other files will be invisible",
+			"scopes", mo.Scopes,
+		)
+	}
+	opts.mount = mo
 	root := &dirNode{
 		commonNode: commonNode{
-			id: rootID,
-			tc: tc,
+			id:   rootID,
+			tc:   tc,
+			opts: &opts,
 		},
 	}
-	server, err := fs.Mount(to, root, &fs.Options{
+	fsOpts := &fs.Options{
 		MountOptions: fuse.MountOptions{
 			FsName: "godrive-fuse",
 		},
 
 		UID: uint32(os.Getuid()),
 		GID: uint32(os.Getgid()),
-	})
+	}
+	mo.setFSOptions(fsOpts)
+	server, err := fs.Mount(to, root, fsOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -55,26 +130,40 @@ func Mount(tc gdrive.TracedClient, rootID string, to string) (*Mountpoint, error
 }
 
 // MountAll mounts multiple mountpoints and blocks until they are all unmounted.
-func MountAll(client *drive.Service, mounts Mountpoints) {
+//
+// clients are keyed by profile names.
+// All mountpoints using the same profile share the same client.
+func MountAll(clients map[string]Client, mounts Mountpoints, opts Options) {
 	var wg sync.WaitGroup
 	servers := make([]*Mountpoint, 0, len(mounts))
-	for to, dir := range mounts {
+	if err := opts.init(); err != nil {
+		log.Fatalw("Unable to initialize mount options", "err", err)
+	}
+	defer opts.inodes.Close()
+	for to, mo := range mounts {
 		to = os.ExpandEnv(to)
 		logger := log.With(
-			"from", dir,
+			"from", mo.source(),
 			"to", to,
+			"profile", mo.Profile,
 		)
-		tc := gdrive.NewTracedClient(client, logger)
-		id, err := tc.FindFile(context.Background(), dir, gdrive.FolderQString)
-		if err != nil || id == "" {
-			tc.Logger.Warnw("Unable to find mount_from, skipping...", "err", err)
+		if mo.SharedDrive != "" {
+			logger = logger.With("sharedDrive", mo.SharedDrive)
+		}
+		client, ok := clients[mo.Profile]
+		if !ok {
+			logger.Error("No client for the profile, skipping...")
 			continue
 		}
-		if dir == "/" {
-			tc.Logger.Errorw("Mounting root google drive currently not supported")
+		mo.Scopes = client.Scopes
+		tc := gdrive.NewTracedClient(client.Service, logger)
+		tc.DriveID = mo.SharedDrive
+		id, err := tc.ResolveFolder(context.Background(), mo.source())
+		if err != nil || id == "" {
+			tc.Logger.Warnw("Unable to find mount_from, skipping...", "err", err)
 			continue
 		}
-		server, err := Mount(tc, id, to)
+		server, err := Mount(tc, id, to, opts, mo)
 		if err != nil {
 			tc.Logger.Errorw("Unable to mount", "err", err)
 			continue
@@ -108,4 +197,5 @@ func MountAll(client *drive.Service, mounts Mountpoints) {
 	)
 
 	wg.Wait()
+	log.Infow("All unmounted", "stats", GetStats())
 }
@@ -0,0 +1,215 @@
+package gfs
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// MountOptions defines the options of a single mountpoint.
+//
+// In config files it can also be a plain string,
+// which will be used as Source with everything else being default.
+type MountOptions struct {
+	// The Drive directory path, or folder id prefixed with gdrive.IDPrefix.
+	// Paths are relative to SharedDrive if it's set.
+	// Default is "/".
+	Source string `yaml:"source"`
+
+	// The id of the shared drive to mount from.
+	// Default is My Drive.
+	SharedDrive string `yaml:"shared_drive"`
+
+	// The OAuth profile to use.
+	// Default is the one from the command line.
+	Profile string `yaml:"profile"`
+
+	// Mount it read-only.
+	ReadOnly bool `yaml:"read_only"`
+
+	// When set, all files are reported as owned by them instead of using the
+	// owner mapping.
+	UID *uint32 `yaml:"uid"`
+	GID *uint32 `yaml:"gid"`
+
+	// When set, the permission bits in it are removed from all files,
+	// e.g. 022 (use a leading 0 for octal).
+	Umask *uint32 `yaml:"umask"`
+
+	// How metadata is cached. Default is CacheAuto.
+	Cache CachePolicy `yaml:"cache"`
+
+	// What to do when deleting files.
+	// Default is DeleteUnparent for My Drive and DeleteTrash for shared drives.
+	DeleteMode DeleteMode `yaml:"delete_mode"`
+
+	// Allow other users to access the mountpoint.
+	// It requires user_allow_other in /etc/fuse.conf.
+	AllowOther bool `yaml:"allow_other"`
+
+	// The OAuth scopes granted to the client of the profile,
+	// used to disable features needing scopes not granted.
+	// If empty, all features are enabled.
+	Scopes []string `yaml:"-"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+//
+// It supports both the plain string form and the full form.
+func (mo *MountOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var source string
+	if err := unmarshal(&source); err == nil {
+		*mo = MountOptions{Source: source}
+		return nil
+	}
+	type plain MountOptions
+	return unmarshal((*plain)(mo))
+}
+
+// CachePolicy defines how metadata is cached.
+type CachePolicy string
+
+// Supported CachePolicy values.
+const (
+	// Cache directory entries locally, but don't let the kernel cache anything.
+	CacheAuto CachePolicy = "auto"
+
+	// Like CacheAuto, but don't use cached directory entries either,
+	// always look up names on Drive.
+	// Metadata and contents of files already looked up are still cached
+	// until they are changed locally.
+	CacheNone CachePolicy = "none"
+
+	// Also let the kernel cache entries, attributes and file contents for
+	// CacheFullTimeout.
+	// Changes made on Drive by others could take that long to show up.
+	CacheFull CachePolicy = "full"
+)
+
+// CacheFullTimeout is how long the kernel caches metadata with CacheFull.
+const CacheFullTimeout = time.Minute
+
+// DeleteMode defines what to do when deleting files.
+type DeleteMode string
+
+// Supported DeleteMode values.
+const (
+	// Only remove the file from the directory.
+	// If it's the only parent of the file,
+	// it will still be accessible via search on Drive.
+	DeleteUnparent DeleteMode = "unparent"
+
+	// Move the file to the trash.
+	DeleteTrash DeleteMode = "trash"
+
+	// Permanently delete the file, skipping the trash.
+	DeletePermanent DeleteMode = "permanent"
+)
+
+// source returns Source with default applied.
+func (mo MountOptions) source() string {
+	if mo.Source == "" {
+		return "/"
+	}
+	return mo.Source
+}
+
+func (mo MountOptions) deleteMode() DeleteMode {
+	if mo.DeleteMode != "" {
+		return mo.DeleteMode
+	}
+	if mo.SharedDrive != "" {
+		// Files in shared drives must have exactly one parent.
+		return DeleteTrash
+	}
+	return DeleteUnparent
+}
+
+// validate checks the enum values in mo.
+func (mo MountOptions) validate() error {
+	switch mo.Cache {
+	default:
+		return fmt.Errorf("unknown cache policy %q", mo.Cache)
+	case "", CacheAuto, CacheNone, CacheFull:
+	}
+	switch mo.DeleteMode {
+	default:
+		return fmt.Errorf("unknown delete mode %q", mo.DeleteMode)
+	case "", DeleteUnparent, DeleteTrash, DeletePermanent:
+	}
+	return nil
+}
+
+// setFSOptions sets the fs options to mount with to opts.
+func (mo MountOptions) setFSOptions(opts *fs.Options) {
+	var timeout time.Duration
+	if mo.Cache == CacheFull {
+		timeout = CacheFullTimeout
+	}
+	opts.EntryTimeout = &timeout
+	opts.AttrTimeout = &timeout
+	opts.NegativeTimeout = &timeout
+	opts.AllowOther = mo.AllowOther
+	if mo.ReadOnly {
+		opts.Options = append(opts.Options, "ro")
+	}
+}
+
+// applyAttr applies the overrides in mo to the attributes.
+func (mo MountOptions) applyAttr(out *fuse.Attr) {
+	if mo.UID != nil {
+		out.Owner.Uid = *mo.UID
+	}
+	if mo.GID != nil {
+		out.Owner.Gid = *mo.GID
+	}
+	if mo.Umask != nil {
+		out.Mode &^= *mo.Umask & 07777
+	}
+	if mo.ReadOnly {
+		out.Mode &^= 0222
+	}
+}
+
+// setAttr fills out with the attributes of e, with the overrides from the
+// mount options applied.
+func (cn *commonNode) setAttr(e *filesCacheEntry, out *fuse.Attr) {
+	e.SetAttr(out)
+	cn.opts.mount.applyAttr(out)
+}
+
+// checkWritable returns EROFS if the mount is read-only.
+//
+// It must be checked before any API calls in mutating operations.
+func (cn *commonNode) checkWritable() syscall.Errno {
+	if cn.opts.mount.ReadOnly {
+		return syscall.EROFS
+	}
+	return 0
+}
+
+// openFlags returns the fuse flags to be returned by Open.
+func (cn *commonNode) openFlags() uint32 {
+	if cn.opts.mount.Cache == CacheFull {
+		return fuse.FOPEN_KEEP_CACHE
+	}
+	return 0
+}
+
+// deleteChild deletes the child with id from the directory,
+// following the delete mode.
+func (dn *dirNode) deleteChild(ctx context.Context, id string) error {
+	tc := dn.commonNode.tc.NewChild()
+	switch dn.commonNode.opts.mount.deleteMode() {
+	default:
+		return tc.DeleteByID(ctx, id, dn.commonNode.id)
+	case DeleteTrash:
+		return tc.TrashByID(ctx, id)
+	case DeletePermanent:
+		return tc.RemoveByID(ctx, id)
+	}
+}
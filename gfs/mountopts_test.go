@@ -0,0 +1,57 @@
+package gfs_test
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"go.yhsif.com/godrive-fuse/gfs"
+)
+
+func TestMountpointsUnmarshalYAML(t *testing.T) {
+	const content = `
+/tmp/plain: /foo/bar
+/tmp/id: id:1AbC
+/tmp/empty:
+/tmp/full:
+  source: /foo
+  shared_drive: 0AbC
+  profile: work
+  read_only: true
+  uid: 1000
+  gid: 100
+  umask: 022
+  cache: none
+  delete_mode: trash
+  allow_other: true
+`
+	uid := uint32(1000)
+	gid := uint32(100)
+	umask := uint32(0022)
+	expected := gfs.Mountpoints{
+		"/tmp/plain": {Source: "/foo/bar"},
+		"/tmp/id":    {Source: "id:1AbC"},
+		"/tmp/empty": {},
+		"/tmp/full": {
+			Source:      "/foo",
+			SharedDrive: "0AbC",
+			Profile:     "work",
+			ReadOnly:    true,
+			UID:         &uid,
+			GID:         &gid,
+			Umask:       &umask,
+			Cache:       gfs.CacheNone,
+			DeleteMode:  gfs.DeleteTrash,
+			AllowOther:  true,
+		},
+	}
+
+	var mounts gfs.Mountpoints
+	if err := yaml.Unmarshal([]byte(content), &mounts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, mounts)
+	}
+}
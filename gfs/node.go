@@ -3,9 +3,13 @@ package gfs
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
 	"io"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,8 +26,21 @@ const (
 	LRUSize = 1000
 )
 
+// The max number of attempts to download a file when the downloaded content
+// doesn't match its md5 checksum.
 const (
-	filesFields = "files(id, name, mimeType, size, createdTime, modifiedTime)"
+	DownloadAttempts = 3
+)
+
+// The delay before the first retry of a download, doubled on each retry.
+var downloadBackoff = 100 * time.Millisecond
+
+// PosixModeKey is the appProperties key used to store permission bits.
+const PosixModeKey = "posix_mode"
+
+const (
+	fileFields  = "id, name, mimeType, size, createdTime, modifiedTime, viewedByMeTime, headRevisionId, md5Checksum, appProperties, " + capabilitiesFields + ", " + ownersFields
+	filesFields = "files(" + fileFields + ")"
 )
 
 // global id -> filesCacheEntry cache
@@ -40,8 +57,14 @@ func init() {
 type commonNode struct {
 	fs.Inode
 
-	id string
-	tc gdrive.TracedClient
+	id   string
+	tc   gdrive.TracedClient
+	opts *Options
+
+	// Metadata used by extended attributes, lazily loaded.
+	xattrLock   sync.Mutex
+	xattrFile   *drive.File
+	xattrLoaded time.Time
 }
 
 func (cn *commonNode) parseTime(s string) *time.Time {
@@ -68,21 +91,58 @@ func (cn *commonNode) cacheFile(f *drive.File) *filesCacheEntry {
 		mode = fuse.S_IFDIR
 		isDir = true
 	}
+	owner := cn.opts.owners.ownerOf(f)
 	entry := &filesCacheEntry{
 		name:   f.Name,
 		id:     f.Id,
 		isDir:  isDir,
 		cached: time.Now(),
-		ino:    IDtoInode(f.Id),
+		ino:    cn.opts.inodes.Inode(f.Id),
+		gen:    cn.opts.inodes.Gen(),
 		mode:   mode,
-		size:   f.Size,
-		ctime:  cn.parseTime(f.CreatedTime),
-		mtime:  cn.parseTime(f.ModifiedTime),
+		perm:   parsePerm(f.AppProperties),
+		caps:   capabilitiesOf(f),
+
+		uid:   owner.uid,
+		gid:   owner.gid,
+		size:  f.Size,
+		atime: cn.parseTime(f.ViewedByMeTime),
+		ctime: cn.parseTime(f.CreatedTime),
+		mtime: cn.parseTime(f.ModifiedTime),
+
+		version: versionOf(f),
 	}
 	globalFilesCache.Add(f.Id, entry)
 	return entry
 }
 
+// parsePerm parses the permission bits stored in appProperties.
+//
+// It returns nil when it's not set or invalid.
+func parsePerm(props map[string]string) *uint32 {
+	s, ok := props[PosixModeKey]
+	if !ok {
+		return nil
+	}
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return nil
+	}
+	masked := uint32(perm) & 07777
+	return &masked
+}
+
+// setPerm sets the permission bits in mode to be stored in appProperties of
+// meta, and returns them.
+func setPerm(meta *drive.File, mode uint32) *uint32 {
+	perm := mode & 07777
+	if meta.AppProperties == nil {
+		meta.AppProperties = make(map[string]string)
+	}
+	meta.AppProperties[PosixModeKey] = strconv.FormatUint(uint64(perm), 8)
+	return &perm
+}
+
 type filesCacheEntry struct {
 	// key fields
 	name   string
@@ -92,12 +152,44 @@ type filesCacheEntry struct {
 
 	// dir entry needed fields
 	ino  uint64
+	gen  uint64
 	mode uint32
 
 	// attr needed fields
+	perm  *uint32 // nil means not set
+	caps  *capabilities
+	uid   uint32
+	gid   uint32
 	size  int64
+	atime *time.Time
 	ctime *time.Time
 	mtime *time.Time
+
+	// content version on Drive
+	version fileVersion
+}
+
+// pendingKey returns the key used by InodeMap for locally created files that
+// are not yet created on Drive.
+//
+// Drive ids never contain "/", so this won't collide with real files.
+func pendingKey(parentID, name string) string {
+	return parentID + "/" + name
+}
+
+// StableAttr returns the fs.StableAttr used by the inode of the entry.
+func (e filesCacheEntry) StableAttr() fs.StableAttr {
+	return fs.StableAttr{
+		Mode: e.mode,
+		Ino:  e.ino,
+		Gen:  e.gen,
+	}
+}
+
+// pending returns true if the entry is a locally created file that's not yet
+// created on Drive.
+func (e filesCacheEntry) pending() bool {
+	return e.id == ""
 }
 
 func (e filesCacheEntry) ToDirEntry() fuse.DirEntry {
@@ -110,31 +202,138 @@ func (e filesCacheEntry) ToDirEntry() fuse.DirEntry {
 
 func (e filesCacheEntry) SetAttr(out *fuse.Attr) {
 	out.Ino = e.ino
+	out.Mode = e.mode | e.Perm()
 	out.Size = uint64(e.size)
-	out.SetTimes(nil, e.mtime, e.ctime)
-	out.Owner.Uid = uint32(syscall.Getuid())
-	out.Owner.Gid = uint32(syscall.Getgid())
+	out.Blksize = BlockSize
+	// st_blocks is always in 512-byte units.
+	out.Blocks = (out.Size + 511) / 512
+	out.SetTimes(e.atime, e.mtime, e.ctime)
+	out.Nlink = 1
+	if e.isDir {
+		// Drive doesn't tell us the number of subdirectories,
+		// 2 is the minimum for a directory.
+		out.Nlink = 2
+	}
+	out.Owner.Uid = e.uid
+	out.Owner.Gid = e.gid
 }
 
 type dirNode struct {
 	commonNode
 
+	// lock protects entry, which is replaced instead of modified in place as
+	// it's shared with the files cache.
+	lock  sync.Mutex
+	entry *filesCacheEntry
+
+	// filesLock serializes replacing entries in filesCache, so that files
+	// listed on Drive never replace pending ones with the same name.
+	filesLock  sync.Mutex
 	filesCache sync.Map
 }
 
 var (
+	_ fs.NodeGetattrer = (*dirNode)(nil)
+	_ fs.NodeSetattrer = (*dirNode)(nil)
 	_ fs.NodeLookuper  = (*dirNode)(nil)
 	_ fs.NodeReaddirer = (*dirNode)(nil)
 	_ fs.NodeUnlinker  = (*dirNode)(nil)
 	_ fs.NodeRmdirer   = (*dirNode)(nil)
 	_ fs.NodeCreater   = (*dirNode)(nil)
 	_ fs.NodeMkdirer   = (*dirNode)(nil)
+	_ fs.NodeRenamer   = (*dirNode)(nil)
 )
 
+func (dn *dirNode) Getattr(ctx context.Context, _ fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	dn.commonNode.tc.Logger.Debugw(
+		"Getattr called",
+		"id", dn.commonNode.id,
+	)
+
+	entry := dn.loadEntry(ctx)
+	if entry == nil {
+		return syscall.EREMOTEIO
+	}
+	dn.commonNode.setAttr(entry, &out.Attr)
+	return 0
+}
+
+// Setattr supports changing the permission bits and mtime of the directory,
+// e.g. by chmod, touch and rsync -a.
+func (dn *dirNode) Setattr(ctx context.Context, _ fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	dn.commonNode.tc.Logger.Debugw(
+		"Setattr called",
+		"id", dn.commonNode.id,
+		"in", *in,
+	)
+
+	if errno := dn.commonNode.checkWritable(); errno != 0 {
+		return errno
+	}
+	if _, ok := in.GetSize(); ok {
+		return syscall.EISDIR
+	}
+	entry := dn.loadEntry(ctx)
+	if entry == nil {
+		return syscall.EREMOTEIO
+	}
+	if !entry.caps.canEdit() {
+		return syscall.EACCES
+	}
+
+	var meta *drive.File
+	if mtime, ok := in.GetMTime(); ok {
+		meta = new(drive.File)
+		meta.ModifiedTime = mtime.UTC().Format(time.RFC3339Nano)
+	}
+	if mode, ok := in.GetMode(); ok {
+		if meta == nil {
+			meta = new(drive.File)
+		}
+		setPerm(meta, mode)
+	}
+	if meta != nil {
+		f, err := dn.commonNode.tc.NewChild().UpdateByID(
+			ctx,
+			dn.commonNode.id,
+			fileFields,
+			meta,
+		)
+		if err != nil {
+			return syscall.EREMOTEIO
+		}
+		entry = dn.commonNode.cacheFile(f)
+		dn.lock.Lock()
+		dn.entry = entry
+		dn.lock.Unlock()
+		dn.invalidateXattrs()
+	}
+	dn.commonNode.setAttr(entry, &out.Attr)
+	return 0
+}
+
+// childrenChanged bumps the mtime of the directory after local changes to its
+// children.
+func (dn *dirNode) childrenChanged(ctx context.Context) {
+	if dn.loadEntry(ctx) == nil {
+		return
+	}
+	now := time.Now()
+	dn.lock.Lock()
+	defer dn.lock.Unlock()
+	entry := *dn.entry
+	entry.mtime = &now
+	dn.entry = &entry
+	globalFilesCache.Add(entry.id, &entry)
+}
+
 func (dn *dirNode) loadCache(ctx context.Context, name string) (entry *filesCacheEntry) {
 	if value, ok := dn.filesCache.Load(name); ok {
 		if entry, ok := value.(*filesCacheEntry); ok {
-			return entry
+			// Pending entries only exist locally.
+			if entry.pending() || dn.commonNode.opts.mount.Cache != CacheNone {
+				return entry
+			}
 		}
 	}
 	err := dn.commonNode.tc.NewChild().ListFiles(
@@ -160,11 +359,22 @@ func (dn *dirNode) loadCache(ctx context.Context, name string) (entry *filesCach
 	return
 }
 
+// cacheFile caches f and returns the entry cached for its name, which is the
+// pending one instead if a file with the same name was created locally and
+// not yet flushed.
 func (dn *dirNode) cacheFile(f *drive.File) *filesCacheEntry {
 	entry := dn.commonNode.cacheFile(f)
-	if !entry.isDir {
-		dn.filesCache.Store(f.Name, entry)
+	if entry.isDir {
+		return entry
+	}
+	dn.filesLock.Lock()
+	defer dn.filesLock.Unlock()
+	if value, ok := dn.filesCache.Load(f.Name); ok {
+		if cached, ok := value.(*filesCacheEntry); ok && cached.pending() {
+			return cached
+		}
 	}
+	dn.filesCache.Store(f.Name, entry)
 	return entry
 }
 
@@ -177,6 +387,10 @@ func (dn *dirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		filesFields,
 		func(f *drive.File) error {
 			entry := dn.cacheFile(f)
+			if entry.pending() {
+				// Shadowed by a local file, listed below.
+				return nil
+			}
 
 			lock.Lock()
 			defer lock.Unlock()
@@ -191,6 +405,12 @@ func (dn *dirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		)
 		return fs.NewListDirStream(files), syscall.ECANCELED
 	}
+	dn.filesCache.Range(func(k, v interface{}) bool {
+		if entry, ok := v.(*filesCacheEntry); ok && entry.pending() {
+			files = append(files, entry.ToDirEntry())
+		}
+		return true
+	})
 	return fs.NewListDirStream(files), 0
 }
 
@@ -205,30 +425,39 @@ func (dn *dirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 	if entry == nil {
 		return nil, syscall.ENOENT
 	}
-
-	attr := fs.StableAttr{
-		Mode: entry.mode,
-		Ino:  entry.ino,
+	if entry.pending() {
+		// Pending files only live in the inode tree until they are flushed.
+		child := dn.GetChild(name)
+		if child == nil {
+			return nil, syscall.ENOENT
+		}
+		dn.commonNode.setAttr(entry, &out.Attr)
+		return child, 0
 	}
+
+	attr := entry.StableAttr()
 	var node fs.InodeEmbedder
 	if entry.isDir {
 		node = &dirNode{
 			commonNode: commonNode{
-				id: entry.id,
-				tc: dn.commonNode.tc,
+				id:   entry.id,
+				tc:   dn.commonNode.tc,
+				opts: dn.commonNode.opts,
 			},
+			entry: entry,
 		}
 	} else {
 		node = &fileNode{
 			commonNode: commonNode{
-				id: entry.id,
-				tc: dn.commonNode.tc,
+				id:   entry.id,
+				tc:   dn.commonNode.tc,
+				opts: dn.commonNode.opts,
 			},
 			entry: entry,
 		}
 	}
 	child := dn.NewInode(ctx, node, attr)
-	entry.SetAttr(&out.Attr)
+	dn.commonNode.setAttr(entry, &out.Attr)
 	return child, 0
 }
 
@@ -240,6 +469,12 @@ func (dn *dirNode) Mkdir(ctx context.Context, name string, mode uint32, out *fus
 		"mode", mode,
 	)
 
+	if errno := dn.commonNode.checkWritable(); errno != 0 {
+		return nil, errno
+	}
+	if errno := dn.checkDir(ctx, (*capabilities).canAddChildren); errno != 0 {
+		return nil, errno
+	}
 	entry := dn.loadCache(ctx, name)
 	if entry != nil {
 		return nil, syscall.EEXIST
@@ -256,18 +491,18 @@ func (dn *dirNode) Mkdir(ctx context.Context, name string, mode uint32, out *fus
 	}
 	entry = dn.cacheFile(file)
 
-	attr := fs.StableAttr{
-		Mode: entry.mode,
-		Ino:  entry.ino,
-	}
+	attr := entry.StableAttr()
 	node := &dirNode{
 		commonNode: commonNode{
-			id: entry.id,
-			tc: dn.commonNode.tc,
+			id:   entry.id,
+			tc:   dn.commonNode.tc,
+			opts: dn.commonNode.opts,
 		},
+		entry: entry,
 	}
 	child := dn.NewInode(ctx, node, attr)
-	entry.SetAttr(&out.Attr)
+	dn.commonNode.setAttr(entry, &out.Attr)
+	dn.childrenChanged(ctx)
 	return child, 0
 }
 
@@ -280,43 +515,57 @@ func (dn *dirNode) Create(ctx context.Context, name string, flags uint32, mode u
 		"mode", mode,
 	)
 
+	if errno = dn.commonNode.checkWritable(); errno != 0 {
+		return
+	}
+	if errno = dn.checkDir(ctx, (*capabilities).canAddChildren); errno != 0 {
+		return
+	}
 	entry := dn.loadCache(ctx, name)
 	if entry != nil {
 		errno = syscall.EEXIST
 		return
 	}
 
-	file, err := dn.commonNode.tc.NewChild().Create(
-		ctx,
-		name,
-		dn.commonNode.id,
-		false, // isDir
-	)
-	if err != nil {
-		errno = syscall.EREMOTEIO
-		return
+	// The file is only created on Drive on its first flush,
+	// so that we can upload its content in the same request.
+	now := time.Now()
+	entry = &filesCacheEntry{
+		name:   name,
+		cached: now,
+		ino:    dn.commonNode.opts.inodes.Inode(pendingKey(dn.commonNode.id, name)),
+		gen:    dn.commonNode.opts.inodes.Gen(),
+		mode:   fuse.S_IFREG,
+		uid:    dn.commonNode.opts.owners.me.uid,
+		gid:    dn.commonNode.opts.owners.me.gid,
+		ctime:  &now,
+		mtime:  &now,
 	}
-	entry = dn.cacheFile(file)
+	dn.filesLock.Lock()
+	dn.filesCache.Store(name, entry)
+	dn.filesLock.Unlock()
 
-	attr := fs.StableAttr{
-		Mode: entry.mode,
-		Ino:  entry.ino,
-	}
+	attr := entry.StableAttr()
 	embedder := &fileNode{
 		commonNode: commonNode{
-			id: entry.id,
-			tc: dn.commonNode.tc,
+			tc:   dn.commonNode.tc,
+			opts: dn.commonNode.opts,
 		},
+		parent: dn,
 		entry:  entry,
 		buffer: new(bytes.Buffer),
 	}
 	fh = embedder
 	node = dn.NewInode(ctx, embedder, attr)
-	entry.SetAttr(&out.Attr)
+	dn.commonNode.setAttr(entry, &out.Attr)
+	dn.childrenChanged(ctx)
 	return
 }
 
 func (dn *dirNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	if errno := dn.commonNode.checkWritable(); errno != 0 {
+		return errno
+	}
 	entry := dn.loadCache(ctx, name)
 	if entry == nil {
 		return syscall.ENOENT
@@ -324,16 +573,38 @@ func (dn *dirNode) Unlink(ctx context.Context, name string) syscall.Errno {
 	if entry.isDir {
 		return syscall.ENOTSUP
 	}
-	err := dn.commonNode.tc.NewChild().DeleteByID(ctx, entry.id, dn.commonNode.id)
+	if entry.pending() {
+		// Never made to Drive, Flush will notice it's gone.
+		if child := dn.GetChild(name); child != nil {
+			if fn, ok := child.Operations().(*fileNode); ok {
+				fn.lock.Lock()
+				fn.unlinked = true
+				fn.lock.Unlock()
+			}
+		}
+		dn.filesCache.Delete(name)
+		dn.commonNode.opts.inodes.Forget(pendingKey(dn.commonNode.id, name))
+		dn.childrenChanged(ctx)
+		return 0
+	}
+	if errno := dn.checkDelete(ctx, entry); errno != 0 {
+		return errno
+	}
+	err := dn.deleteChild(ctx, entry.id)
 	if err != nil {
 		return syscall.EREMOTEIO
 	}
 	dn.filesCache.Delete(name)
 	globalFilesCache.Remove(entry.id)
+	dn.commonNode.opts.inodes.Forget(entry.id)
+	dn.childrenChanged(ctx)
 	return 0
 }
 
 func (dn *dirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if errno := dn.commonNode.checkWritable(); errno != 0 {
+		return errno
+	}
 	entry := dn.loadCache(ctx, name)
 	if entry == nil {
 		return syscall.ENOENT
@@ -341,10 +612,14 @@ func (dn *dirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 	if !entry.isDir {
 		return syscall.ENOTSUP
 	}
+	if errno := dn.checkDelete(ctx, entry); errno != 0 {
+		return errno
+	}
 	newNode := &dirNode{
 		commonNode: commonNode{
-			id: entry.id,
-			tc: dn.commonNode.tc,
+			id:   entry.id,
+			tc:   dn.commonNode.tc,
+			opts: dn.commonNode.opts,
 		},
 	}
 	_, errno := newNode.Readdir(ctx)
@@ -360,21 +635,60 @@ func (dn *dirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 	if found {
 		return syscall.ENOTSUP
 	}
-	err := dn.commonNode.tc.NewChild().DeleteByID(ctx, entry.id, dn.commonNode.id)
+	err := dn.deleteChild(ctx, entry.id)
 	if err != nil {
 		return syscall.EREMOTEIO
 	}
 	dn.filesCache.Delete(name)
 	globalFilesCache.Remove(entry.id)
+	dn.commonNode.opts.inodes.Forget(entry.id)
+	dn.childrenChanged(ctx)
 	return 0
 }
 
+// Rename is not supported yet.
+//
+// It's only implemented to return EROFS on read-only mounts,
+// and EACCES for files we are not allowed to rename.
+func (dn *dirNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if errno := dn.commonNode.checkWritable(); errno != 0 {
+		return errno
+	}
+	if entry := dn.loadCache(ctx, name); entry != nil && !entry.caps.canRename() {
+		return syscall.EACCES
+	}
+	return syscall.ENOTSUP
+}
+
 type fileNode struct {
 	commonNode
 
 	lock   sync.Mutex
 	entry  *filesCacheEntry
 	buffer *bytes.Buffer
+
+	// The version on Drive buffer was loaded from, and whether buffer has local
+	// changes not yet uploaded.
+	base  fileVersion
+	dirty bool
+
+	// The running md5 of the first hashed bytes of buffer, updated by
+	// sequential writes. nil means it needs to be recalculated.
+	hasher hash.Hash
+	hashed int64
+
+	// The parent directory, only set for files created locally and not yet
+	// flushed to Drive.
+	parent *dirNode
+	// Whether the file was unlinked before it was ever flushed to Drive.
+	unlinked bool
+
+	// The server side copy done by CopyFileRange into this file,
+	// reset on any changes to the content.
+	copied *copiedRange
+
+	// Metadata changes not yet sent to Drive.
+	meta *drive.File
 }
 
 var (
@@ -392,7 +706,25 @@ func (fn *fileNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, f
 		"id", fn.commonNode.id,
 		"flags", flags,
 	)
-	return fn, flags, 0
+
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		if errno = fn.commonNode.checkWritable(); errno != 0 {
+			return
+		}
+		if errno = fn.checkEdit(ctx); errno != 0 {
+			return
+		}
+	}
+	return fn, fn.commonNode.openFlags(), 0
+}
+
+// checkEdit returns EACCES if the current user cannot edit the file on Drive.
+func (fn *fileNode) checkEdit(ctx context.Context) syscall.Errno {
+	fn.loadCache(ctx)
+	if fn.entry != nil && !fn.entry.caps.canEdit() {
+		return syscall.EACCES
+	}
+	return 0
 }
 
 func (fn *fileNode) Getattr(ctx context.Context, _ fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
@@ -405,7 +737,7 @@ func (fn *fileNode) Getattr(ctx context.Context, _ fs.FileHandle, out *fuse.Attr
 	if fn.entry == nil {
 		return syscall.ENOENT
 	}
-	fn.entry.SetAttr(&out.Attr)
+	fn.commonNode.setAttr(fn.entry, &out.Attr)
 	return 0
 }
 
@@ -416,21 +748,118 @@ func (fn *fileNode) Setattr(ctx context.Context, _ fs.FileHandle, in *fuse.SetAt
 		"in", *in,
 	)
 
+	if errno := fn.commonNode.checkWritable(); errno != 0 {
+		return errno
+	}
+
 	fn.lock.Lock()
 	defer fn.lock.Unlock()
 
+	if errno := fn.checkEdit(ctx); errno != 0 {
+		return errno
+	}
 	if size, ok := in.GetSize(); ok {
-		fn.resize(ctx, int(size))
-		if fn.buffer == nil {
-			return syscall.EREMOTEIO
+		if errno := fn.resize(ctx, int(size)); errno != 0 {
+			return errno
 		}
+		fn.dirty = true
+		fn.hasher = nil
+		fn.copied = nil
 	}
 
 	fn.loadCache(ctx)
 	if fn.entry == nil {
 		return syscall.EREMOTEIO
 	}
-	fn.entry.SetAttr(&out.Attr)
+	// Kept to be restored if the changes fail to apply.
+	saved := fn.meta
+	if saved != nil {
+		meta := *saved
+		meta.AppProperties = make(map[string]string, len(saved.AppProperties))
+		for k, v := range saved.AppProperties {
+			meta.AppProperties[k] = v
+		}
+		saved = &meta
+	}
+	entry := *fn.entry
+	if mtime, ok := in.GetMTime(); ok {
+		fn.pendingMeta().ModifiedTime = mtime.UTC().Format(time.RFC3339Nano)
+		entry.mtime = &mtime
+	}
+	if mode, ok := in.GetMode(); ok {
+		entry.perm = setPerm(fn.pendingMeta(), mode)
+	}
+	if !fn.dirty && fn.parent == nil {
+		if errno := fn.updateMeta(ctx); errno != 0 {
+			fn.meta = saved
+			return errno
+		}
+	} else {
+		// They will be applied with the content on Flush.
+		fn.setEntry(&entry)
+	}
+	fn.commonNode.setAttr(fn.entry, &out.Attr)
+	return 0
+}
+
+// setEntry replaces the entry of the file, which is shared with the caches
+// and never modified in place.
+//
+// It must be called with fn.lock held.
+func (fn *fileNode) setEntry(entry *filesCacheEntry) {
+	old := fn.entry
+	fn.entry = entry
+	dn := fn.parent
+	if dn == nil {
+		globalFilesCache.Add(entry.id, entry)
+		if _, parent := fn.Parent(); parent != nil {
+			dn, _ = parent.Operations().(*dirNode)
+		}
+	}
+	if dn == nil {
+		return
+	}
+	dn.filesLock.Lock()
+	defer dn.filesLock.Unlock()
+	if value, ok := dn.filesCache.Load(entry.name); ok && value == old {
+		dn.filesCache.Store(entry.name, entry)
+	}
+}
+
+// pendingMeta returns the metadata changes to be sent with the next update.
+//
+// It must be called with fn.lock held.
+func (fn *fileNode) pendingMeta() *drive.File {
+	if fn.meta == nil {
+		fn.meta = new(drive.File)
+	}
+	return fn.meta
+}
+
+// updateMeta applies the pending metadata changes, if any.
+//
+// It must be called with fn.lock held.
+func (fn *fileNode) updateMeta(ctx context.Context) syscall.Errno {
+	if fn.meta == nil {
+		return 0
+	}
+	f, err := fn.commonNode.tc.NewChild().UpdateByID(
+		ctx,
+		fn.commonNode.id,
+		fileFields,
+		fn.meta,
+	)
+	if err != nil {
+		return syscall.EREMOTEIO
+	}
+	fn.meta = nil
+	fn.setEntry(fn.cacheFile(f))
+	if fn.buffer == nil || fn.base.matches(fn.entry.version) {
+		// Otherwise the loaded content is older than the version on Drive,
+		// which must still be detected as a conflict on Flush.
+		fn.base = fn.entry.version
+	}
+	fn.invalidateXattrs()
 	return 0
 }
 
@@ -445,9 +874,8 @@ func (fn *fileNode) Read(ctx context.Context, dest []byte, off int64) (fuse.Read
 	fn.lock.Lock()
 	defer fn.lock.Unlock()
 
-	fn.loadBuffer(ctx)
-	if fn.buffer == nil {
-		return nil, syscall.ENOENT
+	if errno := fn.loadBuffer(ctx); errno != 0 {
+		return nil, errno
 	}
 
 	var size int
@@ -461,7 +889,7 @@ func (fn *fileNode) Read(ctx context.Context, dest []byte, off int64) (fuse.Read
 	return fuse.ReadResultData(dest[:size]), 0
 }
 
-func (fn *fileNode) resize(ctx context.Context, size int) {
+func (fn *fileNode) resize(ctx context.Context, size int) syscall.Errno {
 	defer func() {
 		if fn.buffer != nil {
 			fn.loadCache(ctx)
@@ -472,22 +900,27 @@ func (fn *fileNode) resize(ctx context.Context, size int) {
 	}()
 
 	if size == 0 {
+		if fn.buffer == nil {
+			// We are not loading the content, so use the version we know about as
+			// the base.
+			fn.loadCache(ctx)
+			if fn.entry != nil {
+				fn.base = fn.entry.version
+			}
+		}
 		fn.buffer = new(bytes.Buffer)
-		return
+		return 0
 	}
 
-	fn.loadBuffer(ctx)
-	if fn.buffer == nil {
-		return
+	if errno := fn.loadBuffer(ctx); errno != 0 {
+		return errno
 	}
 	if size < fn.buffer.Len() {
 		fn.buffer.Truncate(size)
-		return
-	}
-	if size > fn.buffer.Len() {
+	} else if size > fn.buffer.Len() {
 		fn.buffer.ReadFrom(io.LimitReader(nullReader{}, int64(size-fn.buffer.Len())))
-		return
 	}
+	return 0
 }
 
 func (fn *fileNode) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
@@ -498,14 +931,23 @@ func (fn *fileNode) Write(ctx context.Context, data []byte, off int64) (written
 		"off", off,
 	)
 
+	if errno = fn.commonNode.checkWritable(); errno != 0 {
+		return
+	}
+
 	fn.lock.Lock()
 	defer fn.lock.Unlock()
 
-	fn.resize(ctx, int(off))
-	if fn.buffer == nil {
-		return 0, syscall.ENOENT
+	if errno = fn.checkEdit(ctx); errno != 0 {
+		return
+	}
+	if errno = fn.resize(ctx, int(off)); errno != 0 {
+		return
 	}
 	n, _ := fn.buffer.Write(data)
+	fn.dirty = true
+	fn.copied = nil
+	fn.hash(data[:n], off)
 	fn.loadCache(ctx)
 	if fn.entry != nil {
 		fn.entry.size = off + int64(n)
@@ -522,18 +964,123 @@ func (fn *fileNode) Flush(ctx context.Context) syscall.Errno {
 	fn.lock.Lock()
 	defer fn.lock.Unlock()
 
+	if fn.parent != nil {
+		return fn.createRemote(ctx)
+	}
+	if !fn.dirty {
+		return 0
+	}
+
+	remote, upload, errno := fn.checkConflict(ctx)
+	if !upload {
+		return errno
+	}
+	if remote.md5 != "" && remote.md5 == fn.contentMD5() {
+		fn.commonNode.tc.Logger.Debugw(
+			"Content unchanged, skipping upload",
+			"id", fn.commonNode.id,
+			"md5", remote.md5,
+		)
+		atomic.AddUint64(&globalStats.SkippedUploads, 1)
+		fn.base = remote
+		fn.dirty = false
+		// Still apply the requested metadata changes, e.g. modifiedTime.
+		return fn.updateMeta(ctx)
+	}
+
 	f, err := fn.commonNode.tc.NewChild().UpdateMediaByID(
 		ctx,
 		fn.commonNode.id,
-		strings.NewReader(fn.buffer.String()),
+		fileFields,
+		fn.meta,
+		bytes.NewReader(fn.buffer.Bytes()),
+	)
+	if err != nil {
+		return syscall.EREMOTEIO
+	}
+	fn.meta = nil
+	fn.copied = nil
+	atomic.AddUint64(&globalStats.Uploads, 1)
+	fn.entry = fn.cacheFile(f)
+	fn.base = fn.entry.version
+	fn.dirty = false
+	fn.invalidateXattrs()
+	return 0
+}
+
+// hash feeds data written at off into the running md5.
+//
+// It must be called with fn.lock held, after data is written into buffer.
+func (fn *fileNode) hash(data []byte, off int64) {
+	if fn.hasher == nil || fn.hashed != off {
+		// Not a sequential write, start over from the content before it.
+		fn.hasher = md5.New()
+		fn.hasher.Write(fn.buffer.Bytes()[:off])
+		fn.hashed = off
+	}
+	fn.hasher.Write(data)
+	fn.hashed += int64(len(data))
+}
+
+// contentMD5 returns the hex encoded md5 of buffer.
+//
+// It must be called with fn.lock held.
+func (fn *fileNode) contentMD5() string {
+	if fn.hasher != nil && fn.hashed == int64(fn.buffer.Len()) {
+		return hex.EncodeToString(fn.hasher.Sum(nil))
+	}
+	sum := md5.Sum(fn.buffer.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// createRemote creates a locally created file on Drive with its content.
+//
+// It must be called with fn.lock held.
+func (fn *fileNode) createRemote(ctx context.Context) syscall.Errno {
+	dn := fn.parent
+	name := fn.entry.name
+	if fn.unlinked {
+		// Unlinked before it's ever flushed.
+		fn.parent = nil
+		return 0
+	}
+
+	f, err := fn.commonNode.tc.NewChild().CreateWithMedia(
+		ctx,
+		name,
+		dn.commonNode.id,
+		fileFields,
+		fn.meta,
+		bytes.NewReader(fn.buffer.Bytes()),
 	)
 	if err != nil {
 		return syscall.EREMOTEIO
 	}
-	fn.cacheFile(f)
+	fn.meta = nil
+	fn.remoteCreated(f)
+	fn.dirty = false
+	atomic.AddUint64(&globalStats.Uploads, 1)
 	return 0
 }
 
+// remoteCreated binds a locally created file to f, the file created for it on
+// Drive.
+//
+// It must be called with fn.lock held.
+func (fn *fileNode) remoteCreated(f *drive.File) {
+	// Keep the inode number the kernel already knows about.
+	fn.commonNode.opts.inodes.Move(pendingKey(fn.parent.commonNode.id, fn.entry.name), f.Id)
+	fn.commonNode.id = f.Id
+	entry := fn.commonNode.cacheFile(f)
+	dn := fn.parent
+	dn.filesLock.Lock()
+	dn.filesCache.Store(f.Name, entry)
+	dn.filesLock.Unlock()
+	fn.parent = nil
+	fn.entry = entry
+	fn.base = entry.version
+}
+
 func (fn *fileNode) loadCache(ctx context.Context) {
 	if fn.entry != nil {
 		return
@@ -544,22 +1091,57 @@ func (fn *fileNode) loadCache(ctx context.Context) {
 			return
 		}
 	}
-	f, _ := fn.commonNode.tc.NewChild().GetByID(ctx, fn.commonNode.id, filesFields)
+	f, _ := fn.commonNode.tc.NewChild().GetByID(ctx, fn.commonNode.id, fileFields)
 	if f != nil {
 		fn.entry = fn.cacheFile(f)
 	}
 }
 
-func (fn *fileNode) loadBuffer(ctx context.Context) {
+// loadBuffer downloads the content into buffer if it's not already loaded.
+//
+// The downloaded content is verified against the md5 checksum from Drive,
+// and retried up to DownloadAttempts times on mismatch, waiting
+// downloadBackoff before the first retry and twice as long for each one after.
+func (fn *fileNode) loadBuffer(ctx context.Context) syscall.Errno {
 	if fn.buffer != nil {
-		return
+		return 0
 	}
-	buffer, err := fn.commonNode.tc.NewChild().DownloadByID(ctx, fn.commonNode.id)
-	if err == nil {
+	if !fn.commonNode.opts.scopes.content {
+		return syscall.EACCES
+	}
+	tc := fn.commonNode.tc.NewChild()
+	for i := 0; i < DownloadAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return syscall.EINTR
+			case <-time.After(downloadBackoff << (i - 1)):
+			}
+		}
+		// Fetch the metadata first, so that we know which version we are loading.
+		f, err := tc.GetByID(ctx, fn.commonNode.id, fileFields)
+		if err != nil {
+			return syscall.EREMOTEIO
+		}
+		buffer, err := tc.DownloadByID(ctx, fn.commonNode.id, f.Md5Checksum)
+		if err == gdrive.ErrMD5Mismatch {
+			// Either corrupted, or changed between the two calls. Try again.
+			continue
+		}
+		if err != nil {
+			return syscall.EREMOTEIO
+		}
+		fn.entry = fn.cacheFile(f)
+		fn.base = fn.entry.version
 		fn.buffer = buffer
-		globalFilesCache.Add(fn.commonNode.id, buffer)
+		return 0
 	}
-	return
+	fn.commonNode.tc.Logger.Errorw(
+		"Giving up downloading after md5 mismatches",
+		"id", fn.commonNode.id,
+		"attempts", DownloadAttempts,
+	)
+	return syscall.EIO
 }
 
 type nullReader struct{}
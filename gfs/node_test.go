@@ -0,0 +1,640 @@
+package gfs
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"google.golang.org/api/drive/v3"
+
+	"go.yhsif.com/godrive-fuse/gdrive"
+)
+
+// create creates a file in dn, and returns it as the file handle.
+func create(t *testing.T, dn *dirNode, name string) *fileNode {
+	t.Helper()
+	var out fuse.EntryOut
+	child, fh, _, errno := dn.Create(context.Background(), name, 0, 0644, &out)
+	if errno != 0 {
+		t.Fatalf("Create(%q) failed: %v", name, errno)
+	}
+	// Done by the fuse bridge when it's mounted.
+	dn.AddChild(name, child, true)
+	return fh.(*fileNode)
+}
+
+// write writes content into fn at off.
+func write(t *testing.T, fn *fileNode, content string, off int64) {
+	t.Helper()
+	n, errno := fn.Write(context.Background(), []byte(content), off)
+	if errno != 0 {
+		t.Fatalf("Write failed: %v", errno)
+	}
+	if int(n) != len(content) {
+		t.Fatalf("Write expected to write %d bytes, got %d", len(content), n)
+	}
+}
+
+func TestDeferredCreate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("flush", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		root := fd.mount(Options{}, MountOptions{})
+		fn := create(t, root, "file.txt")
+		write(t, fn, "hello, ", 0)
+		write(t, fn, "world", 7)
+		if n := fd.count("POST upload"); n != 0 {
+			t.Fatalf("Expected no creates before flush, got %d", n)
+		}
+
+		// Pending files are visible locally.
+		stream, errno := root.Readdir(ctx)
+		if errno != 0 {
+			t.Fatalf("Readdir failed: %v", errno)
+		}
+		var names []string
+		for stream.HasNext() {
+			e, _ := stream.Next()
+			names = append(names, e.Name)
+		}
+		if len(names) != 1 || names[0] != "file.txt" {
+			t.Errorf("Readdir expected [file.txt], got %v", names)
+		}
+
+		if errno := fn.Flush(ctx); errno != 0 {
+			t.Fatalf("Flush failed: %v", errno)
+		}
+		if n := fd.count("POST upload"); n != 1 {
+			t.Errorf("Expected 1 create with content, got %d", n)
+		}
+		f := fd.find(fd.rootID, "file.txt")
+		if f == nil {
+			t.Fatal("File not created on Drive")
+		}
+		if content := fd.content(f.Id); content != "hello, world" {
+			t.Errorf("Expected content %q, got %q", "hello, world", content)
+		}
+		if fn.commonNode.id != f.Id {
+			t.Errorf("Expected node id %q after flush, got %q", f.Id, fn.commonNode.id)
+		}
+
+		// Nothing changed since, so there's nothing to upload.
+		if errno := fn.Flush(ctx); errno != 0 {
+			t.Fatalf("Second flush failed: %v", errno)
+		}
+		if n := fd.count("POST upload") + fd.count("PATCH upload"); n != 1 {
+			t.Errorf("Expected no more uploads on second flush, got %d uploads", n)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		root := fd.mount(Options{}, MountOptions{})
+		fn := create(t, root, "empty")
+		if errno := fn.Flush(ctx); errno != 0 {
+			t.Fatalf("Flush failed: %v", errno)
+		}
+		f := fd.find(fd.rootID, "empty")
+		if f == nil {
+			t.Fatal("Empty file not created on Drive")
+		}
+		if f.Size != 0 {
+			t.Errorf("Expected empty file, got size %d", f.Size)
+		}
+	})
+
+	t.Run("unlinked", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		root := fd.mount(Options{}, MountOptions{})
+		fn := create(t, root, "tmp")
+		write(t, fn, "scratch", 0)
+		if errno := root.Unlink(ctx, "tmp"); errno != 0 {
+			t.Fatalf("Unlink failed: %v", errno)
+		}
+		if errno := fn.Flush(ctx); errno != 0 {
+			t.Fatalf("Flush failed: %v", errno)
+		}
+		if n := fd.count("POST upload"); n != 0 {
+			t.Errorf("Expected no creates for unlinked file, got %d", n)
+		}
+		if f := fd.find(fd.rootID, "tmp"); f != nil {
+			t.Errorf("Unlinked file created on Drive: %+v", f)
+		}
+	})
+
+	t.Run("exists", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		root := fd.mount(Options{}, MountOptions{})
+		create(t, root, "file")
+		var out fuse.EntryOut
+		_, _, _, errno := root.Create(ctx, "file", 0, 0644, &out)
+		if errno != syscall.EEXIST {
+			t.Errorf("Create on pending file expected EEXIST, got %v", errno)
+		}
+	})
+
+	t.Run("listed-meanwhile", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		root := fd.mount(Options{}, MountOptions{})
+		fn := create(t, root, "file")
+		write(t, fn, "local", 0)
+		// Created on Drive by someone else before the local file is flushed.
+		remoteID := fd.add(&drive.File{Name: "file"}, []byte("remote"))
+
+		stream, errno := root.Readdir(ctx)
+		if errno != 0 {
+			t.Fatalf("Readdir failed: %v", errno)
+		}
+		var names []string
+		for stream.HasNext() {
+			e, _ := stream.Next()
+			names = append(names, e.Name)
+		}
+		if len(names) != 1 || names[0] != "file" {
+			t.Errorf("Readdir expected [file], got %v", names)
+		}
+
+		if errno := fn.Flush(ctx); errno != 0 {
+			t.Fatalf("Flush failed: %v", errno)
+		}
+		if n := fd.count("POST upload"); n != 1 {
+			t.Fatalf("Expected 1 create with content, got %d", n)
+		}
+		if fn.commonNode.id == "" || fn.commonNode.id == remoteID {
+			t.Fatalf("Expected a new file on Drive, got id %q", fn.commonNode.id)
+		}
+		if got := fd.content(fn.commonNode.id); got != "local" {
+			t.Errorf("Expected uploaded content %q, got %q", "local", got)
+		}
+		if got := fd.content(remoteID); got != "remote" {
+			t.Errorf("Expected remote file unchanged, got %q", got)
+		}
+	})
+}
+
+// lookup looks up name in dn, and returns its node.
+func lookup(t *testing.T, dn *dirNode, name string) fs.InodeEmbedder {
+	t.Helper()
+	var out fuse.EntryOut
+	child, errno := dn.Lookup(context.Background(), name, &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(%q) failed: %v", name, errno)
+	}
+	// Done by the fuse bridge when it's mounted.
+	dn.AddChild(name, child, true)
+	return child.Operations()
+}
+
+func TestSkipUnchangedUpload(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		Label    string
+		Content  string
+		MTime    bool
+		Uploads  int
+		Patches  int
+		Skipped  uint64
+		Expected string
+	}{
+		{
+			Label:    "same",
+			Content:  "hello",
+			Skipped:  1,
+			Expected: "hello",
+		},
+		{
+			Label:    "same-with-mtime",
+			Content:  "hello",
+			MTime:    true,
+			Patches:  1,
+			Skipped:  1,
+			Expected: "hello",
+		},
+		{
+			Label:    "changed",
+			Content:  "world",
+			Uploads:  1,
+			Expected: "world",
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			fd := newFakeDrive(t)
+			id := fd.add(&drive.File{Name: "file"}, []byte("hello"))
+			root := fd.mount(Options{}, MountOptions{})
+			fn := lookup(t, root, "file").(*fileNode)
+
+			write(t, fn, c.Content, 0)
+			if c.MTime {
+				var out fuse.AttrOut
+				in := &fuse.SetAttrIn{}
+				in.Valid = fuse.FATTR_MTIME
+				in.Mtime = 1234567890
+				if errno := fn.Setattr(ctx, nil, in, &out); errno != 0 {
+					t.Fatalf("Setattr failed: %v", errno)
+				}
+			}
+			before := GetStats()
+			if errno := fn.Flush(ctx); errno != 0 {
+				t.Fatalf("Flush failed: %v", errno)
+			}
+			after := GetStats()
+
+			if n := fd.count("PATCH upload"); n != c.Uploads {
+				t.Errorf("Expected %d uploads, got %d", c.Uploads, n)
+			}
+			if n := fd.count("PATCH files"); n != c.Patches {
+				t.Errorf("Expected %d metadata updates, got %d", c.Patches, n)
+			}
+			if n := after.SkippedUploads - before.SkippedUploads; n != c.Skipped {
+				t.Errorf("Expected %d skipped uploads, got %d", c.Skipped, n)
+			}
+			if content := fd.content(id); content != c.Expected {
+				t.Errorf("Expected content %q, got %q", c.Expected, content)
+			}
+			if c.MTime {
+				if mtime := fd.get(id).ModifiedTime; mtime != "2009-02-13T23:31:30Z" {
+					t.Errorf("Expected mtime applied, got %q", mtime)
+				}
+			}
+			if fn.dirty {
+				t.Error("File still dirty after flush")
+			}
+		})
+	}
+}
+
+// setattr calls Setattr on node with mode and/or mtime.
+func setattr(t *testing.T, node fs.NodeSetattrer, mode *uint32, mtime *uint64) (fuse.AttrOut, syscall.Errno) {
+	t.Helper()
+	in := &fuse.SetAttrIn{}
+	if mode != nil {
+		in.Valid |= fuse.FATTR_MODE
+		in.Mode = *mode
+	}
+	if mtime != nil {
+		in.Valid |= fuse.FATTR_MTIME
+		in.Mtime = *mtime
+	}
+	var out fuse.AttrOut
+	errno := node.Setattr(context.Background(), nil, in, &out)
+	return out, errno
+}
+
+func TestSetattr(t *testing.T) {
+	ctx := context.Background()
+	mode := func(m uint32) *uint32 { return &m }
+	const mtime = uint64(1234567890)
+	const mtimeString = "2009-02-13T23:31:30Z"
+
+	for _, c := range []struct {
+		Label    string
+		Mode     uint32
+		Expected string
+	}{
+		{
+			Label:    "0600",
+			Mode:     0600,
+			Expected: "600",
+		},
+		{
+			Label:    "000",
+			Mode:     0,
+			Expected: "0",
+		},
+		{
+			Label:    "with-type-bits",
+			Mode:     fuse.S_IFREG | 04755,
+			Expected: "4755",
+		},
+	} {
+		t.Run("file-"+c.Label, func(t *testing.T) {
+			fd := newFakeDrive(t)
+			id := fd.add(&drive.File{Name: "file"}, []byte("content"))
+			root := fd.mount(Options{}, MountOptions{})
+			fn := lookup(t, root, "file").(*fileNode)
+			out, errno := setattr(t, fn, &c.Mode, nil)
+			if errno != 0 {
+				t.Fatalf("Setattr failed: %v", errno)
+			}
+			if got := fd.get(id).AppProperties[PosixModeKey]; got != c.Expected {
+				t.Errorf("Expected %s stored as %q, got %q", PosixModeKey, c.Expected, got)
+			}
+			if perm := out.Mode & 07777; perm != c.Mode&07777 {
+				t.Errorf("Expected perm %o, got %o", c.Mode&07777, perm)
+			}
+		})
+	}
+
+	t.Run("round-trip", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		fd.add(&drive.File{
+			Name:          "none",
+			AppProperties: map[string]string{PosixModeKey: "0"},
+		}, nil)
+		fd.add(&drive.File{Name: "unset"}, nil)
+		root := fd.mount(Options{}, MountOptions{})
+		for name, expected := range map[string]uint32{
+			"none":  0,
+			"unset": DefaultFilePerm,
+		} {
+			var out fuse.EntryOut
+			if _, errno := root.Lookup(ctx, name, &out); errno != 0 {
+				t.Fatalf("Lookup(%q) failed: %v", name, errno)
+			}
+			if perm := out.Mode & 07777; perm != expected {
+				t.Errorf("%s: expected perm %o, got %o", name, expected, perm)
+			}
+		}
+	})
+
+	t.Run("dir", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		id := fd.add(&drive.File{Name: "dir", MimeType: gdrive.FolderMimeType}, nil)
+		root := fd.mount(Options{}, MountOptions{})
+		dn := lookup(t, root, "dir").(*dirNode)
+		m, ts := uint32(0700), mtime
+		out, errno := setattr(t, dn, &m, &ts)
+		if errno != 0 {
+			t.Fatalf("Setattr on directory failed: %v", errno)
+		}
+		f := fd.get(id)
+		if got := f.AppProperties[PosixModeKey]; got != "700" {
+			t.Errorf("Expected %s stored as %q, got %q", PosixModeKey, "700", got)
+		}
+		if f.ModifiedTime != mtimeString {
+			t.Errorf("Expected mtime %q, got %q", mtimeString, f.ModifiedTime)
+		}
+		if out.Mode != fuse.S_IFDIR|0700 {
+			t.Errorf("Expected mode %o, got %o", fuse.S_IFDIR|0700, out.Mode)
+		}
+		if out.Mtime != mtime {
+			t.Errorf("Expected mtime %d, got %d", mtime, out.Mtime)
+		}
+
+		in := &fuse.SetAttrIn{}
+		in.Valid = fuse.FATTR_SIZE
+		if errno := dn.Setattr(ctx, nil, in, &fuse.AttrOut{}); errno != syscall.EISDIR {
+			t.Errorf("Truncating directory expected EISDIR, got %v", errno)
+		}
+	})
+
+	t.Run("failed-update", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		fd.add(&drive.File{Name: "file"}, []byte("content"))
+		root := fd.mount(Options{}, MountOptions{})
+		fn := lookup(t, root, "file").(*fileNode)
+		fd.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method != http.MethodPatch {
+				return false
+			}
+			http.Error(w, "backend error", http.StatusInternalServerError)
+			return true
+		}
+		ts := mtime
+		if _, errno := setattr(t, fn, mode(0600), &ts); errno != syscall.EREMOTEIO {
+			t.Fatalf("Setattr expected EREMOTEIO, got %v", errno)
+		}
+		if fn.entry.perm != nil {
+			t.Errorf("Expected perm unchanged, got %o", *fn.entry.perm)
+		}
+		if fn.entry.mtime.Unix() == int64(mtime) {
+			t.Error("Expected mtime unchanged")
+		}
+		if fn.meta != nil {
+			t.Errorf("Expected no pending metadata left, got %+v", fn.meta)
+		}
+		if value, _ := root.filesCache.Load("file"); value != fn.entry {
+			t.Error("Expected the cached entry unchanged")
+		}
+	})
+
+	t.Run("stale-buffer", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		id := fd.add(&drive.File{Name: "file"}, []byte("base"))
+		root := fd.mount(Options{ConflictPolicy: ConflictFail}, MountOptions{})
+		fn := lookup(t, root, "file").(*fileNode)
+		if _, errno := fn.Read(ctx, make([]byte, 4), 0); errno != 0 {
+			t.Fatalf("Read failed: %v", errno)
+		}
+		fd.modify(id, []byte("remote"))
+		// Updates the metadata right away as there are no local changes.
+		if _, errno := setattr(t, fn, mode(0600), nil); errno != 0 {
+			t.Fatalf("Setattr failed: %v", errno)
+		}
+		// Still based on the content read before the change on Drive.
+		write(t, fn, "local", 0)
+		if errno := fn.Flush(ctx); errno != ConflictErrno {
+			t.Errorf("Flush expected %v, got %v", ConflictErrno, errno)
+		}
+		if got := fd.content(id); got != "remote" {
+			t.Errorf("Expected content on Drive %q, got %q", "remote", got)
+		}
+	})
+
+	t.Run("conflict-copy", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		id := fd.add(&drive.File{Name: "file.txt"}, []byte("base"))
+		root := fd.mount(Options{ConflictPolicy: ConflictCopy}, MountOptions{})
+		fn := lookup(t, root, "file.txt").(*fileNode)
+		write(t, fn, "local", 0)
+		ts := mtime
+		if _, errno := setattr(t, fn, mode(0600), &ts); errno != 0 {
+			t.Fatalf("Setattr failed: %v", errno)
+		}
+		fd.modify(id, []byte("remote"))
+		if errno := fn.Flush(ctx); errno != 0 {
+			t.Fatalf("Flush failed: %v", errno)
+		}
+
+		var copied *drive.File
+		for _, f := range fd.children(fd.rootID) {
+			if strings.HasPrefix(f.Name, "file (conflict ") {
+				copied = f
+			}
+		}
+		if copied == nil {
+			t.Fatal("Conflict copy not created")
+		}
+		if got := fd.content(copied.Id); got != "local" {
+			t.Errorf("Expected conflict copy content %q, got %q", "local", got)
+		}
+		if got := copied.AppProperties[PosixModeKey]; got != "600" {
+			t.Errorf("Expected conflict copy %s %q, got %q", PosixModeKey, "600", got)
+		}
+		if copied.ModifiedTime != mtimeString {
+			t.Errorf("Expected conflict copy mtime %q, got %q", mtimeString, copied.ModifiedTime)
+		}
+		if original := fd.get(id); original.AppProperties[PosixModeKey] != "" {
+			t.Errorf("Metadata changes applied to the original file: %v", original.AppProperties)
+		}
+	})
+}
+
+func TestConflictPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("fail", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		id := fd.add(&drive.File{Name: "file.txt"}, []byte("base"))
+		root := fd.mount(Options{ConflictPolicy: ConflictFail}, MountOptions{})
+		fn := lookup(t, root, "file.txt").(*fileNode)
+		write(t, fn, "local", 0)
+		fd.modify(id, []byte("remote"))
+		if errno := fn.Flush(ctx); errno != ConflictErrno {
+			t.Fatalf("Flush expected %v, got %v", ConflictErrno, errno)
+		}
+		if n := fd.count("PATCH upload") + fd.count("POST upload"); n != 0 {
+			t.Errorf("Expected no uploads, got %d", n)
+		}
+		if got := fd.content(id); got != "remote" {
+			t.Errorf("Expected content on Drive %q, got %q", "remote", got)
+		}
+		fn.lock.Lock()
+		dirty := fn.dirty
+		content := fn.buffer.String()
+		fn.lock.Unlock()
+		if !dirty {
+			t.Error("Expected local changes to stay dirty")
+		}
+		if content != "local" {
+			t.Errorf("Expected local content %q, got %q", "local", content)
+		}
+		// Still conflicting on the next flush.
+		if errno := fn.Flush(ctx); errno != ConflictErrno {
+			t.Errorf("Second flush expected %v, got %v", ConflictErrno, errno)
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		fd := newFakeDrive(t)
+		id := fd.add(&drive.File{Name: "file.txt"}, []byte("base"))
+		root := fd.mount(Options{ConflictPolicy: ConflictOverwrite}, MountOptions{})
+		fn := lookup(t, root, "file.txt").(*fileNode)
+		write(t, fn, "local", 0)
+		fd.modify(id, []byte("remote"))
+		if errno := fn.Flush(ctx); errno != 0 {
+			t.Fatalf("Flush failed: %v", errno)
+		}
+		if n := fd.count("PATCH upload"); n != 1 {
+			t.Errorf("Expected 1 upload, got %d", n)
+		}
+		if n := fd.count("POST upload"); n != 0 {
+			t.Errorf("Expected no conflict copies, got %d creates", n)
+		}
+		if got := fd.content(id); got != "local" {
+			t.Errorf("Expected content on Drive %q, got %q", "local", got)
+		}
+		fn.lock.Lock()
+		dirty := fn.dirty
+		fn.lock.Unlock()
+		if dirty {
+			t.Error("Expected no local changes left after overwrite")
+		}
+	})
+}
+
+func TestDownloadMismatch(t *testing.T) {
+	ctx := context.Background()
+	defer func(backoff time.Duration) {
+		downloadBackoff = backoff
+	}(downloadBackoff)
+	downloadBackoff = time.Millisecond
+
+	for _, c := range []struct {
+		Label string
+		Call  func(fn *fileNode) syscall.Errno
+	}{
+		{
+			Label: "write",
+			Call: func(fn *fileNode) syscall.Errno {
+				_, errno := fn.Write(ctx, []byte("data"), 2)
+				return errno
+			},
+		},
+		{
+			Label: "truncate",
+			Call: func(fn *fileNode) syscall.Errno {
+				in := &fuse.SetAttrIn{}
+				in.Valid = fuse.FATTR_SIZE
+				in.Size = 2
+				return fn.Setattr(ctx, nil, in, &fuse.AttrOut{})
+			},
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			fd := newFakeDrive(t)
+			fd.add(&drive.File{Name: "file"}, []byte("hello"))
+			var downloads int
+			fd.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.URL.Query().Get("alt") != "media" {
+					return false
+				}
+				downloads++
+				w.Write([]byte("corrupted"))
+				return true
+			}
+			root := fd.mount(Options{}, MountOptions{})
+			fn := lookup(t, root, "file").(*fileNode)
+			if errno := c.Call(fn); errno != syscall.EIO {
+				t.Errorf("Expected EIO, got %v", errno)
+			}
+			if downloads != DownloadAttempts {
+				t.Errorf("Expected %d download attempts, got %d", DownloadAttempts, downloads)
+			}
+			if fn.dirty {
+				t.Error("Expected no local changes after the failed download")
+			}
+		})
+	}
+}
+
+func TestChildrenChanged(t *testing.T) {
+	ctx := context.Background()
+	fd := newFakeDrive(t)
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fd.lock.Lock()
+	fd.files[fd.rootID].ModifiedTime = old.UTC().Format(time.RFC3339Nano)
+	fd.lock.Unlock()
+	// No Getattr on root before creating children.
+	root := fd.mount(Options{}, MountOptions{})
+
+	mtime := func() time.Time {
+		t.Helper()
+		var out fuse.AttrOut
+		if errno := root.Getattr(ctx, nil, &out); errno != 0 {
+			t.Fatalf("Getattr failed: %v", errno)
+		}
+		return time.Unix(int64(out.Mtime), int64(out.Mtimensec))
+	}
+
+	// Getattr concurrently with the changes, for the race detector.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			mtime()
+		}
+	}()
+	before := time.Now()
+	create(t, root, "file")
+	wg.Wait()
+	if got := mtime(); got.Before(before) {
+		t.Errorf("Expected mtime after %v once a child is created, got %v", before, got)
+	}
+
+	before = time.Now()
+	if errno := root.Unlink(ctx, "file"); errno != 0 {
+		t.Fatalf("Unlink failed: %v", errno)
+	}
+	if got := mtime(); got.Before(before) {
+		t.Errorf("Expected mtime after %v once a child is unlinked, got %v", before, got)
+	}
+}
@@ -0,0 +1,145 @@
+package gfs
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/reddit/baseplate.go/log"
+	"google.golang.org/api/drive/v3"
+)
+
+// ownedByMe is in capabilitiesFields.
+const ownersFields = "owners(emailAddress)"
+
+// OwnerMapping maps Drive owners to local users and groups.
+type OwnerMapping struct {
+	// Keys are email addresses of Drive owners.
+	Users map[string]LocalOwner `yaml:"users"`
+
+	// Keys are domains of Drive owners' email addresses,
+	// used when the email address is not in Users.
+	Domains map[string]LocalOwner `yaml:"domains"`
+
+	// Used by owners not mapped by Users or Domains.
+	// Default is the user running the mount.
+	DefaultUID *uint32 `yaml:"default_uid"`
+	DefaultGID *uint32 `yaml:"default_gid"`
+}
+
+// LocalOwner defines a local user and group, by either name or numeric id.
+//
+// If Group is empty, the primary group of User will be used.
+type LocalOwner struct {
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+}
+
+type owner struct {
+	uid uint32
+	gid uint32
+}
+
+// ownerMap is the resolved version of OwnerMapping.
+type ownerMap struct {
+	users    map[string]owner
+	domains  map[string]owner
+	me       owner
+	fallback owner
+}
+
+// resolve resolves all the user and group names in the mapping.
+//
+// Entries that cannot be resolved are logged and skipped.
+func (m OwnerMapping) resolve() *ownerMap {
+	me := owner{
+		uid: uint32(os.Getuid()),
+		gid: uint32(os.Getgid()),
+	}
+	om := &ownerMap{
+		users:    make(map[string]owner, len(m.Users)),
+		domains:  make(map[string]owner, len(m.Domains)),
+		me:       me,
+		fallback: me,
+	}
+	if m.DefaultUID != nil {
+		om.fallback.uid = *m.DefaultUID
+	}
+	if m.DefaultGID != nil {
+		om.fallback.gid = *m.DefaultGID
+	}
+	for email, lo := range m.Users {
+		o, err := lo.resolve()
+		if err != nil {
+			log.Errorw("Unable to resolve local owner, skipping...", "email", email, "err", err)
+			continue
+		}
+		om.users[strings.ToLower(email)] = o
+	}
+	for domain, lo := range m.Domains {
+		o, err := lo.resolve()
+		if err != nil {
+			log.Errorw("Unable to resolve local owner, skipping...", "domain", domain, "err", err)
+			continue
+		}
+		om.domains[strings.ToLower(domain)] = o
+	}
+	return om
+}
+
+func (lo LocalOwner) resolve() (o owner, err error) {
+	var u *user.User
+	if o.uid, err = parseID(lo.User); err != nil {
+		if u, err = user.Lookup(lo.User); err != nil {
+			return
+		}
+		if o.uid, err = parseID(u.Uid); err != nil {
+			return
+		}
+	}
+
+	group := lo.Group
+	if group == "" {
+		// Use the primary group of the user.
+		if u == nil {
+			if u, err = user.LookupId(lo.User); err != nil {
+				return
+			}
+		}
+		group = u.Gid
+	}
+	if o.gid, err = parseID(group); err == nil {
+		return
+	}
+	var g *user.Group
+	if g, err = user.LookupGroup(group); err != nil {
+		return
+	}
+	o.gid, err = parseID(g.Gid)
+	return
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// ownerOf returns the local owner of a Drive file.
+func (om *ownerMap) ownerOf(f *drive.File) owner {
+	if f.OwnedByMe {
+		return om.me
+	}
+	for _, o := range f.Owners {
+		email := strings.ToLower(o.EmailAddress)
+		if local, ok := om.users[email]; ok {
+			return local
+		}
+		if i := strings.LastIndex(email, "@"); i >= 0 {
+			if local, ok := om.domains[email[i+1:]]; ok {
+				return local
+			}
+		}
+	}
+	return om.fallback
+}
@@ -0,0 +1,124 @@
+package gfs
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestOwnerMappingResolve(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("Unable to get current user: %v", err)
+	}
+	uid, _ := strconv.ParseUint(current.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(current.Gid, 10, 32)
+	defaultUID := uint32(2000)
+
+	m := OwnerMapping{
+		Users: map[string]LocalOwner{
+			"Alice@Example.com": {User: "1001", Group: "1002"},
+			"bob@example.com":   {User: current.Username},
+			"carol@example.com": {User: current.Uid, Group: current.Gid},
+			"bad@example.com":   {User: "no-such-user-godrive-fuse"},
+		},
+		Domains: map[string]LocalOwner{
+			"Example.org": {User: "1003", Group: "1004"},
+		},
+		DefaultUID: &defaultUID,
+	}
+	om := m.resolve()
+
+	me := owner{uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+	if om.me != me {
+		t.Errorf("Expected me %+v, got %+v", me, om.me)
+	}
+	if expected := (owner{uid: defaultUID, gid: me.gid}); om.fallback != expected {
+		t.Errorf("Expected fallback %+v, got %+v", expected, om.fallback)
+	}
+	for email, expected := range map[string]owner{
+		// Keys are case insensitive.
+		"alice@example.com": {uid: 1001, gid: 1002},
+		// Group defaults to the primary group of the user.
+		"bob@example.com":   {uid: uint32(uid), gid: uint32(gid)},
+		"carol@example.com": {uid: uint32(uid), gid: uint32(gid)},
+	} {
+		if got, ok := om.users[email]; !ok || got != expected {
+			t.Errorf("%s: expected %+v, got %+v (%v)", email, expected, got, ok)
+		}
+	}
+	if got, ok := om.users["bad@example.com"]; ok {
+		t.Errorf("Unresolvable user expected to be skipped, got %+v", got)
+	}
+	if got, expected := om.domains["example.org"], (owner{uid: 1003, gid: 1004}); got != expected {
+		t.Errorf("example.org: expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestOwnerOf(t *testing.T) {
+	om := &ownerMap{
+		users: map[string]owner{
+			"alice@example.com": {uid: 1001, gid: 1002},
+		},
+		domains: map[string]owner{
+			"example.com": {uid: 1003, gid: 1004},
+		},
+		me:       owner{uid: 1, gid: 2},
+		fallback: owner{uid: 3, gid: 4},
+	}
+	owners := func(emails ...string) []*drive.User {
+		users := make([]*drive.User, 0, len(emails))
+		for _, email := range emails {
+			users = append(users, &drive.User{EmailAddress: email})
+		}
+		return users
+	}
+	for _, c := range []struct {
+		Label    string
+		File     *drive.File
+		Expected owner
+	}{
+		{
+			Label: "mine",
+			File: &drive.File{
+				OwnedByMe: true,
+				Owners:    owners("alice@example.com"),
+			},
+			Expected: om.me,
+		},
+		{
+			Label:    "user",
+			File:     &drive.File{Owners: owners("Alice@Example.COM")},
+			Expected: owner{uid: 1001, gid: 1002},
+		},
+		{
+			Label:    "domain",
+			File:     &drive.File{Owners: owners("dave@example.com")},
+			Expected: owner{uid: 1003, gid: 1004},
+		},
+		{
+			Label:    "first-mapped",
+			File:     &drive.File{Owners: owners("eve@example.net", "alice@example.com")},
+			Expected: owner{uid: 1001, gid: 1002},
+		},
+		{
+			Label:    "unmapped",
+			File:     &drive.File{Owners: owners("eve@example.net")},
+			Expected: om.fallback,
+		},
+		{
+			Label:    "no-owners",
+			File:     &drive.File{},
+			Expected: om.fallback,
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			if got := om.ownerOf(c.File); got != c.Expected {
+				t.Errorf("ownerOf expected %+v, got %+v", c.Expected, got)
+			}
+		})
+	}
+}
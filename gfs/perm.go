@@ -0,0 +1,139 @@
+package gfs
+
+import (
+	"context"
+	"syscall"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Default permission bits used when they are not stored in appProperties.
+const (
+	DefaultFilePerm = 0644
+	DefaultDirPerm  = 0755
+)
+
+const capabilitiesFields = "capabilities(canEdit, canDelete, canTrash, canRename, canAddChildren, canRemoveChildren), ownedByMe"
+
+// capabilities are what the current user can do to a file on Drive.
+//
+// A nil *capabilities means unknown, and everything is allowed.
+type capabilities struct {
+	edit           bool
+	delete         bool
+	trash          bool
+	rename         bool
+	addChildren    bool
+	removeChildren bool
+}
+
+func capabilitiesOf(f *drive.File) *capabilities {
+	if f.Capabilities == nil {
+		return nil
+	}
+	return &capabilities{
+		edit:           f.Capabilities.CanEdit,
+		delete:         f.Capabilities.CanDelete,
+		trash:          f.Capabilities.CanTrash,
+		rename:         f.Capabilities.CanRename,
+		addChildren:    f.Capabilities.CanAddChildren,
+		removeChildren: f.Capabilities.CanRemoveChildren,
+	}
+}
+
+func (c *capabilities) canEdit() bool {
+	return c == nil || c.edit
+}
+
+func (c *capabilities) canDelete() bool {
+	return c == nil || c.delete
+}
+
+func (c *capabilities) canTrash() bool {
+	return c == nil || c.trash
+}
+
+func (c *capabilities) canRename() bool {
+	return c == nil || c.rename
+}
+
+func (c *capabilities) canAddChildren() bool {
+	return c == nil || c.addChildren
+}
+
+func (c *capabilities) canRemoveChildren() bool {
+	return c == nil || c.removeChildren
+}
+
+// Perm returns the permission bits of the entry.
+//
+// Write bits are always removed when the current user cannot write to it on
+// Drive.
+func (e filesCacheEntry) Perm() uint32 {
+	var perm uint32 = DefaultFilePerm
+	writable := e.caps.canEdit()
+	if e.isDir {
+		perm = DefaultDirPerm
+		writable = e.caps.canAddChildren()
+	}
+	if e.perm != nil {
+		perm = *e.perm
+	}
+	if !writable {
+		perm &^= 0222
+	}
+	return perm
+}
+
+// loadEntry loads the cache entry of the directory itself.
+func (dn *dirNode) loadEntry(ctx context.Context) *filesCacheEntry {
+	dn.lock.Lock()
+	defer dn.lock.Unlock()
+
+	if dn.entry != nil {
+		return dn.entry
+	}
+	if value, ok := globalFilesCache.Get(dn.commonNode.id); ok {
+		if entry, ok := value.(*filesCacheEntry); ok {
+			dn.entry = entry
+			return entry
+		}
+	}
+	f, _ := dn.commonNode.tc.NewChild().GetByID(ctx, dn.commonNode.id, fileFields)
+	if f != nil {
+		dn.entry = dn.commonNode.cacheFile(f)
+	}
+	return dn.entry
+}
+
+// checkDir checks the capability of the directory using check,
+// returns EACCES if it's not allowed.
+func (dn *dirNode) checkDir(ctx context.Context, check func(*capabilities) bool) syscall.Errno {
+	entry := dn.loadEntry(ctx)
+	if entry != nil && !check(entry.caps) {
+		return syscall.EACCES
+	}
+	return 0
+}
+
+// checkDelete checks whether entry can be deleted from the directory with the
+// delete mode of the mount, returns EACCES if it's not allowed.
+//
+// Unparenting only changes the directory, so it's checked against the
+// directory's capabilities, while trashing and deleting are checked against
+// the file's own capabilities.
+func (dn *dirNode) checkDelete(ctx context.Context, entry *filesCacheEntry) syscall.Errno {
+	switch dn.commonNode.opts.mount.deleteMode() {
+	default:
+		return dn.checkDir(ctx, (*capabilities).canRemoveChildren)
+	case DeleteTrash:
+		if !entry.caps.canTrash() {
+			return syscall.EACCES
+		}
+	case DeletePermanent:
+		if !entry.caps.canDelete() {
+			return syscall.EACCES
+		}
+	}
+	return 0
+}
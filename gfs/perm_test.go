@@ -0,0 +1,163 @@
+package gfs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestPerm(t *testing.T) {
+	perm := func(p uint32) *uint32 { return &p }
+	for _, c := range []struct {
+		Label    string
+		IsDir    bool
+		Perm     *uint32
+		Caps     *capabilities
+		Expected uint32
+	}{
+		{
+			Label:    "file-default",
+			Expected: DefaultFilePerm,
+		},
+		{
+			Label:    "dir-default",
+			IsDir:    true,
+			Expected: DefaultDirPerm,
+		},
+		{
+			Label:    "file-editable",
+			Caps:     &capabilities{edit: true},
+			Expected: 0644,
+		},
+		{
+			Label:    "file-view-only",
+			Caps:     &capabilities{},
+			Expected: 0444,
+		},
+		{
+			Label:    "dir-view-only",
+			IsDir:    true,
+			Caps:     &capabilities{edit: true},
+			Expected: 0555,
+		},
+		{
+			Label:    "dir-can-add",
+			IsDir:    true,
+			Caps:     &capabilities{addChildren: true},
+			Expected: 0755,
+		},
+		{
+			Label:    "file-stored",
+			Perm:     perm(0600),
+			Caps:     &capabilities{edit: true},
+			Expected: 0600,
+		},
+		{
+			Label:    "file-stored-view-only",
+			Perm:     perm(0640),
+			Caps:     &capabilities{},
+			Expected: 0440,
+		},
+		{
+			Label:    "file-stored-none",
+			Perm:     perm(0),
+			Expected: 0,
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			e := filesCacheEntry{
+				isDir: c.IsDir,
+				perm:  c.Perm,
+				caps:  c.Caps,
+			}
+			if got := e.Perm(); got != c.Expected {
+				t.Errorf("Perm() expected %o, got %o", c.Expected, got)
+			}
+		})
+	}
+}
+
+func TestCheckDelete(t *testing.T) {
+	for _, c := range []struct {
+		Label    string
+		Mode     DeleteMode
+		Parent   *drive.FileCapabilities
+		File     *drive.FileCapabilities
+		Expected syscall.Errno
+	}{
+		{
+			Label:  "unparent-allowed",
+			Mode:   DeleteUnparent,
+			Parent: &drive.FileCapabilities{CanRemoveChildren: true},
+			File:   &drive.FileCapabilities{},
+		},
+		{
+			Label:    "unparent-denied",
+			Mode:     DeleteUnparent,
+			Parent:   &drive.FileCapabilities{},
+			File:     &drive.FileCapabilities{CanTrash: true, CanDelete: true},
+			Expected: syscall.EACCES,
+		},
+		{
+			Label:  "trash-allowed",
+			Mode:   DeleteTrash,
+			Parent: &drive.FileCapabilities{},
+			File:   &drive.FileCapabilities{CanTrash: true},
+		},
+		{
+			Label:    "trash-denied",
+			Mode:     DeleteTrash,
+			Parent:   &drive.FileCapabilities{CanRemoveChildren: true},
+			File:     &drive.FileCapabilities{CanDelete: true},
+			Expected: syscall.EACCES,
+		},
+		{
+			Label:  "permanent-allowed",
+			Mode:   DeletePermanent,
+			Parent: &drive.FileCapabilities{},
+			File:   &drive.FileCapabilities{CanDelete: true},
+		},
+		{
+			Label:    "permanent-denied",
+			Mode:     DeletePermanent,
+			Parent:   &drive.FileCapabilities{CanRemoveChildren: true},
+			File:     &drive.FileCapabilities{CanTrash: true},
+			Expected: syscall.EACCES,
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			fd := newFakeDrive(t)
+			fd.files[fd.rootID].Capabilities = c.Parent
+			id := fd.add(&drive.File{Name: "file", Capabilities: c.File}, nil)
+			root := fd.mount(Options{}, MountOptions{DeleteMode: c.Mode})
+			errno := root.Unlink(context.Background(), "file")
+			if errno != c.Expected {
+				t.Errorf("Unlink expected %v, got %v", c.Expected, errno)
+			}
+			if c.Expected != 0 {
+				if fd.get(id) == nil {
+					t.Error("File deleted on Drive")
+				}
+				if n := fd.count("PATCH files") + fd.count("DELETE files"); n != 0 {
+					t.Errorf("Expected no requests to delete, got %d", n)
+				}
+			}
+		})
+	}
+}
+
+func TestRenameCapability(t *testing.T) {
+	fd := newFakeDrive(t)
+	fd.add(&drive.File{Name: "fixed", Capabilities: &drive.FileCapabilities{}}, nil)
+	fd.add(&drive.File{Name: "movable", Capabilities: &drive.FileCapabilities{CanRename: true}}, nil)
+	root := fd.mount(Options{}, MountOptions{})
+	ctx := context.Background()
+	if errno := root.Rename(ctx, "fixed", root, "new", 0); errno != syscall.EACCES {
+		t.Errorf("Rename without canRename expected EACCES, got %v", errno)
+	}
+	if errno := root.Rename(ctx, "movable", root, "new", 0); errno != syscall.ENOTSUP {
+		t.Errorf("Rename with canRename expected ENOTSUP, got %v", errno)
+	}
+}
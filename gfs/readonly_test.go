@@ -0,0 +1,138 @@
+package gfs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"google.golang.org/api/drive/v3"
+
+	"go.yhsif.com/godrive-fuse/gdrive"
+)
+
+func TestReadOnlyMount(t *testing.T) {
+	ctx := context.Background()
+	fd := newFakeDrive(t)
+	fileID := fd.add(&drive.File{Name: "file"}, []byte("content"))
+	fd.add(&drive.File{Name: "other"}, []byte("other"))
+	fd.add(&drive.File{Name: "dir", MimeType: gdrive.FolderMimeType}, nil)
+	root := fd.mount(Options{}, MountOptions{ReadOnly: true})
+	fn := lookup(t, root, "file").(*fileNode)
+	other := lookup(t, root, "other").(*fileNode)
+	dn := lookup(t, root, "dir").(*dirNode)
+	mode := uint32(0600)
+
+	for _, c := range []struct {
+		Label string
+		Op    func() syscall.Errno
+	}{
+		{
+			Label: "mkdir",
+			Op: func() syscall.Errno {
+				_, errno := root.Mkdir(ctx, "newdir", 0755, &fuse.EntryOut{})
+				return errno
+			},
+		},
+		{
+			Label: "create",
+			Op: func() syscall.Errno {
+				_, _, _, errno := root.Create(ctx, "newfile", 0, 0644, &fuse.EntryOut{})
+				return errno
+			},
+		},
+		{
+			Label: "unlink",
+			Op:    func() syscall.Errno { return root.Unlink(ctx, "file") },
+		},
+		{
+			Label: "rmdir",
+			Op:    func() syscall.Errno { return root.Rmdir(ctx, "dir") },
+		},
+		{
+			Label: "rename",
+			Op:    func() syscall.Errno { return root.Rename(ctx, "file", root, "moved", 0) },
+		},
+		{
+			Label: "open-write",
+			Op: func() syscall.Errno {
+				_, _, errno := fn.Open(ctx, syscall.O_WRONLY)
+				return errno
+			},
+		},
+		{
+			Label: "open-rdwr",
+			Op: func() syscall.Errno {
+				_, _, errno := fn.Open(ctx, syscall.O_RDWR)
+				return errno
+			},
+		},
+		{
+			Label: "write",
+			Op: func() syscall.Errno {
+				_, errno := fn.Write(ctx, []byte("changed"), 0)
+				return errno
+			},
+		},
+		{
+			Label: "setattr-file",
+			Op: func() syscall.Errno {
+				_, errno := setattr(t, fn, &mode, nil)
+				return errno
+			},
+		},
+		{
+			Label: "setattr-dir",
+			Op: func() syscall.Errno {
+				_, errno := setattr(t, dn, &mode, nil)
+				return errno
+			},
+		},
+		{
+			Label: "setxattr",
+			Op: func() syscall.Errno {
+				return fn.Setxattr(ctx, XattrPropPrefix+"color", []byte("red"), 0)
+			},
+		},
+		{
+			Label: "removexattr",
+			Op:    func() syscall.Errno { return fn.Removexattr(ctx, XattrPrefix+"description") },
+		},
+		{
+			Label: "copy-file-range",
+			Op: func() syscall.Errno {
+				_, errno := fn.CopyFileRange(ctx, fn, 0, other.EmbeddedInode(), other, 0, uint64(len("content")), 0)
+				return errno
+			},
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			if errno := c.Op(); errno != syscall.EROFS {
+				t.Errorf("Expected EROFS, got %v", errno)
+			}
+		})
+	}
+
+	// Reading still works.
+	if _, _, errno := fn.Open(ctx, syscall.O_RDONLY); errno != 0 {
+		t.Errorf("Open for reading failed: %v", errno)
+	}
+	if errno := fn.Flush(ctx); errno != 0 {
+		t.Errorf("Flush failed: %v", errno)
+	}
+
+	for _, kind := range []string{
+		"POST files",
+		"POST upload",
+		"PATCH files",
+		"PATCH upload",
+		"DELETE files",
+	} {
+		if n := fd.count(kind); n != 0 {
+			t.Errorf("Expected no %q requests on read-only mount, got %d", kind, n)
+		}
+	}
+	if content := fd.content(fileID); content != "content" {
+		t.Errorf("Expected content unchanged, got %q", content)
+	}
+}
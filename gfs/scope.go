@@ -0,0 +1,63 @@
+package gfs
+
+import (
+	"google.golang.org/api/drive/v3"
+)
+
+// scopeSet is what the granted OAuth scopes allow us to do.
+type scopeSet struct {
+	// Changing files on Drive.
+	write bool
+	// Downloading file contents.
+	content bool
+	// Seeing all files instead of only the ones created by this app.
+	all bool
+}
+
+// allScopes is used when the granted scopes are unknown.
+var allScopes = scopeSet{
+	write:   true,
+	content: true,
+	all:     true,
+}
+
+var knownScopes = map[string]scopeSet{
+	drive.DriveScope: allScopes,
+	drive.DriveFileScope: {
+		write:   true,
+		content: true,
+	},
+	drive.DriveReadonlyScope: {
+		content: true,
+		all:     true,
+	},
+	drive.DriveMetadataReadonlyScope: {
+		all: true,
+	},
+	drive.DriveMetadataScope: {
+		all: true,
+	},
+}
+
+// scopesOf returns the combined scopeSet of the granted OAuth scopes.
+//
+// Empty scopes means unknown, and everything is allowed.
+func scopesOf(scopes []string) scopeSet {
+	if len(scopes) == 0 {
+		return allScopes
+	}
+	var set scopeSet
+	for _, scope := range scopes {
+		s := knownScopes[scope]
+		set.write = set.write || s.write
+		set.content = set.content || s.content
+		set.all = set.all || s.all
+	}
+	return set
+}
+
+// IsReadOnlyScopes returns true if none of the OAuth scopes allows changing
+// files on Drive.
+func IsReadOnlyScopes(scopes []string) bool {
+	return !scopesOf(scopes).write
+}
@@ -0,0 +1,51 @@
+package gfs_test
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+
+	"go.yhsif.com/godrive-fuse/gfs"
+)
+
+func TestIsReadOnlyScopes(t *testing.T) {
+	for _, c := range []struct {
+		Scopes   []string
+		Expected bool
+	}{
+		{
+			Scopes:   nil,
+			Expected: false,
+		},
+		{
+			Scopes:   []string{drive.DriveScope},
+			Expected: false,
+		},
+		{
+			Scopes:   []string{drive.DriveFileScope},
+			Expected: false,
+		},
+		{
+			Scopes:   []string{drive.DriveReadonlyScope},
+			Expected: true,
+		},
+		{
+			Scopes:   []string{drive.DriveMetadataReadonlyScope, drive.DriveReadonlyScope},
+			Expected: true,
+		},
+		{
+			Scopes:   []string{drive.DriveReadonlyScope, drive.DriveFileScope},
+			Expected: false,
+		},
+	} {
+		t.Run(
+			strings.Join(c.Scopes, ","),
+			func(t *testing.T) {
+				if actual := gfs.IsReadOnlyScopes(c.Scopes); actual != c.Expected {
+					t.Errorf("IsReadOnlyScopes(%q) expected %v, got %v", c.Scopes, c.Expected, actual)
+				}
+			},
+		)
+	}
+}
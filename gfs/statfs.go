@@ -0,0 +1,91 @@
+package gfs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"google.golang.org/api/drive/v3"
+)
+
+// StatfsCacheTTL is how long the storage quota used by statfs is cached.
+const StatfsCacheTTL = time.Second * 30
+
+// Values used by statfs.
+const (
+	// The block size reported.
+	BlockSize = 4096
+
+	// The free space reported for accounts with unlimited storage.
+	UnlimitedFree = 1 << 50 // 1 PiB
+
+	// The number of files reported, Drive doesn't really have a limit.
+	StatfsFiles = 1 << 32
+
+	// The max filename length reported.
+	NameLen = 255
+)
+
+type quotaCacheEntry struct {
+	quota  *drive.AboutStorageQuota
+	cached time.Time
+}
+
+// Storage quota cache, shared by all mountpoints using the same account.
+var (
+	quotaCacheLock sync.Mutex
+	quotaCache     = make(map[*drive.Service]quotaCacheEntry)
+)
+
+var (
+	_ fs.NodeStatfser = (*dirNode)(nil)
+	_ fs.NodeStatfser = (*fileNode)(nil)
+)
+
+func (cn *commonNode) loadQuota(ctx context.Context) (*drive.AboutStorageQuota, error) {
+	quotaCacheLock.Lock()
+	defer quotaCacheLock.Unlock()
+
+	if entry, ok := quotaCache[cn.tc.Service]; ok && time.Since(entry.cached) < StatfsCacheTTL {
+		return entry.quota, nil
+	}
+	quota, err := cn.tc.NewChild().GetStorageQuota(ctx)
+	if err != nil {
+		return nil, err
+	}
+	quotaCache[cn.tc.Service] = quotaCacheEntry{
+		quota:  quota,
+		cached: time.Now(),
+	}
+	return quota, nil
+}
+
+func (cn *commonNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	quota, err := cn.loadQuota(ctx)
+	if err != nil {
+		return syscall.EREMOTEIO
+	}
+	used := uint64(quota.Usage)
+	total := uint64(quota.Limit)
+	if total == 0 {
+		// Unlimited
+		total = used + UnlimitedFree
+	}
+	free := uint64(0)
+	if total > used {
+		free = total - used
+	}
+
+	out.Bsize = BlockSize
+	out.Frsize = BlockSize
+	out.Blocks = total / BlockSize
+	out.Bfree = free / BlockSize
+	out.Bavail = out.Bfree
+	out.Files = StatfsFiles
+	out.Ffree = StatfsFiles
+	out.NameLen = NameLen
+	return 0
+}
@@ -0,0 +1,99 @@
+package gfs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestStatfs(t *testing.T) {
+	const gib = 1 << 30
+	for _, c := range []struct {
+		Label  string
+		Quota  drive.AboutStorageQuota
+		Blocks uint64
+		Bfree  uint64
+	}{
+		{
+			Label:  "limited",
+			Quota:  drive.AboutStorageQuota{Limit: 15 * gib, Usage: 5*gib + 1},
+			Blocks: 15 * gib / BlockSize,
+			// Partially used blocks are not free.
+			Bfree: (10*gib - 1) / BlockSize,
+		},
+		{
+			Label:  "unlimited",
+			Quota:  drive.AboutStorageQuota{Usage: 5 * gib},
+			Blocks: (5*gib + UnlimitedFree) / BlockSize,
+			Bfree:  UnlimitedFree / BlockSize,
+		},
+		{
+			Label:  "over-quota",
+			Quota:  drive.AboutStorageQuota{Limit: 15 * gib, Usage: 20 * gib},
+			Blocks: 15 * gib / BlockSize,
+			Bfree:  0,
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			fd := newFakeDrive(t)
+			fd.quota = c.Quota
+			root := fd.mount(Options{}, MountOptions{})
+			var out fuse.StatfsOut
+			if errno := root.Statfs(context.Background(), &out); errno != 0 {
+				t.Fatalf("Statfs failed: %v", errno)
+			}
+			if out.Bsize != BlockSize || out.Frsize != BlockSize {
+				t.Errorf("Expected block size %d, got %d/%d", BlockSize, out.Bsize, out.Frsize)
+			}
+			if out.Blocks != c.Blocks {
+				t.Errorf("Expected %d blocks, got %d", c.Blocks, out.Blocks)
+			}
+			if out.Bfree != c.Bfree || out.Bavail != c.Bfree {
+				t.Errorf("Expected %d free blocks, got %d/%d", c.Bfree, out.Bfree, out.Bavail)
+			}
+		})
+	}
+}
+
+func TestStatfsCache(t *testing.T) {
+	fd := newFakeDrive(t)
+	fd.quota = drive.AboutStorageQuota{Limit: 1 << 30, Usage: 0}
+	root := fd.mount(Options{}, MountOptions{})
+	fn := create(t, root, "file")
+	ctx := context.Background()
+	statfs := func() fuse.StatfsOut {
+		t.Helper()
+		var out fuse.StatfsOut
+		if errno := fn.Statfs(ctx, &out); errno != 0 {
+			t.Fatalf("Statfs failed: %v", errno)
+		}
+		return out
+	}
+
+	statfs()
+	fd.quota.Usage = 1 << 29
+	// Cached, and shared by all the nodes using the same service.
+	if out := statfs(); out.Bfree != (1<<30)/BlockSize {
+		t.Errorf("Expected cached quota with %d free blocks, got %d", (1<<30)/BlockSize, out.Bfree)
+	}
+	if n := fd.count("GET about"); n != 1 {
+		t.Errorf("Expected 1 about request, got %d", n)
+	}
+
+	// Expire the cache.
+	quotaCacheLock.Lock()
+	entry := quotaCache[root.tc.Service]
+	entry.cached = time.Now().Add(-StatfsCacheTTL)
+	quotaCache[root.tc.Service] = entry
+	quotaCacheLock.Unlock()
+
+	if out := statfs(); out.Bfree != (1<<29)/BlockSize {
+		t.Errorf("Expected refreshed quota with %d free blocks, got %d", (1<<29)/BlockSize, out.Bfree)
+	}
+	if n := fd.count("GET about"); n != 2 {
+		t.Errorf("Expected 2 about requests, got %d", n)
+	}
+}
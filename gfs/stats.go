@@ -0,0 +1,24 @@
+package gfs
+
+import (
+	"sync/atomic"
+)
+
+// Stats are the counters of gfs operations, shared by all mountpoints.
+type Stats struct {
+	// Number of file contents uploaded to Drive.
+	Uploads uint64
+
+	// Number of uploads skipped because the content on Drive is identical.
+	SkippedUploads uint64
+}
+
+var globalStats Stats
+
+// GetStats returns a snapshot of the current stats.
+func GetStats() Stats {
+	return Stats{
+		Uploads:        atomic.LoadUint64(&globalStats.Uploads),
+		SkippedUploads: atomic.LoadUint64(&globalStats.SkippedUploads),
+	}
+}
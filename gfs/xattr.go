@@ -0,0 +1,310 @@
+package gfs
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// XattrPrefix is the prefix of all the extended attributes exposing Drive
+// metadata.
+const XattrPrefix = "user.drive."
+
+// XattrPropPrefix is the prefix of extended attributes mapped to Drive
+// properties, which are visible to other apps.
+const XattrPropPrefix = "user.prop."
+
+// MaxPropertySize is the max size of a property's key and value combined,
+// as defined by Drive API.
+const MaxPropertySize = 124
+
+// XattrCacheTTL is how long the metadata fetched for extended attributes is
+// cached.
+//
+// They are fetched lazily on the first xattr call instead of with other
+// metadata, so that listing directories doesn't need to fetch them.
+const XattrCacheTTL = time.Second * 5
+
+const xattrFields = "id, mimeType, md5Checksum, webViewLink, owners(emailAddress), description, headRevisionId, parents, starred, properties, capabilities(canEdit)"
+
+// xattrs maps the extended attribute names (without XattrPrefix) to how to get
+// their values from a Drive file, and how to set them for writable ones.
+//
+// set is called with the value to set, or nil to remove it.
+var xattrs = []struct {
+	name  string
+	value func(f *drive.File) string
+	set   func(meta *drive.File, value []byte) syscall.Errno
+}{
+	{
+		name:  "id",
+		value: func(f *drive.File) string { return f.Id },
+	},
+	{
+		name:  "mimeType",
+		value: func(f *drive.File) string { return f.MimeType },
+	},
+	{
+		name:  "md5",
+		value: func(f *drive.File) string { return f.Md5Checksum },
+	},
+	{
+		name:  "webViewLink",
+		value: func(f *drive.File) string { return f.WebViewLink },
+	},
+	{
+		name: "owners",
+		value: func(f *drive.File) string {
+			emails := make([]string, 0, len(f.Owners))
+			for _, o := range f.Owners {
+				emails = append(emails, o.EmailAddress)
+			}
+			return strings.Join(emails, ",")
+		},
+	},
+	{
+		name:  "description",
+		value: func(f *drive.File) string { return f.Description },
+		set: func(meta *drive.File, value []byte) syscall.Errno {
+			meta.Description = string(value)
+			meta.ForceSendFields = append(meta.ForceSendFields, "Description")
+			return 0
+		},
+	},
+	{
+		name:  "starred",
+		value: func(f *drive.File) string { return strconv.FormatBool(f.Starred) },
+		set: func(meta *drive.File, value []byte) syscall.Errno {
+			if value != nil {
+				starred, err := strconv.ParseBool(string(value))
+				if err != nil {
+					return syscall.EINVAL
+				}
+				meta.Starred = starred
+			}
+			meta.ForceSendFields = append(meta.ForceSendFields, "Starred")
+			return 0
+		},
+	},
+	{
+		name:  "headRevisionId",
+		value: func(f *drive.File) string { return f.HeadRevisionId },
+	},
+	{
+		name:  "parents",
+		value: func(f *drive.File) string { return strings.Join(f.Parents, ",") },
+	},
+}
+
+var (
+	_ fs.NodeGetxattrer    = (*dirNode)(nil)
+	_ fs.NodeListxattrer   = (*dirNode)(nil)
+	_ fs.NodeSetxattrer    = (*dirNode)(nil)
+	_ fs.NodeRemovexattrer = (*dirNode)(nil)
+	_ fs.NodeGetxattrer    = (*fileNode)(nil)
+	_ fs.NodeListxattrer   = (*fileNode)(nil)
+	_ fs.NodeSetxattrer    = (*fileNode)(nil)
+	_ fs.NodeRemovexattrer = (*fileNode)(nil)
+)
+
+// copyXattr copies value into dest following getxattr/listxattr semantics.
+func copyXattr(dest []byte, value []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+// loadXattrs fetches the metadata used by extended attributes,
+// or returns the cached one if it's still fresh.
+func (cn *commonNode) loadXattrs(ctx context.Context) (*drive.File, syscall.Errno) {
+	cn.xattrLock.Lock()
+	defer cn.xattrLock.Unlock()
+
+	if cn.xattrFile != nil && time.Since(cn.xattrLoaded) < XattrCacheTTL {
+		return cn.xattrFile, 0
+	}
+	f, err := cn.tc.NewChild().GetByID(ctx, cn.id, xattrFields)
+	if err != nil {
+		return nil, syscall.EREMOTEIO
+	}
+	cn.xattrFile = f
+	cn.xattrLoaded = time.Now()
+	return f, 0
+}
+
+// invalidateXattrs drops the cached metadata used by extended attributes.
+func (cn *commonNode) invalidateXattrs() {
+	cn.xattrLock.Lock()
+	defer cn.xattrLock.Unlock()
+	cn.xattrFile = nil
+}
+
+func (cn *commonNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if cn.id == "" {
+		return 0, syscall.ENODATA
+	}
+	if key := strings.TrimPrefix(attr, XattrPropPrefix); key != attr && key != "" {
+		f, errno := cn.loadXattrs(ctx)
+		if errno != 0 {
+			return 0, errno
+		}
+		value, ok := f.Properties[key]
+		if !ok {
+			return 0, syscall.ENODATA
+		}
+		return copyXattr(dest, []byte(value))
+	}
+	if !strings.HasPrefix(attr, XattrPrefix) {
+		return 0, syscall.ENODATA
+	}
+	name := strings.TrimPrefix(attr, XattrPrefix)
+	for _, x := range xattrs {
+		if x.name != name {
+			continue
+		}
+		f, errno := cn.loadXattrs(ctx)
+		if errno != 0 {
+			return 0, errno
+		}
+		value := x.value(f)
+		if value == "" {
+			return 0, syscall.ENODATA
+		}
+		return copyXattr(dest, []byte(value))
+	}
+	return 0, syscall.ENODATA
+}
+
+func (cn *commonNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if cn.id == "" {
+		return 0, 0
+	}
+	f, errno := cn.loadXattrs(ctx)
+	if errno != 0 {
+		return 0, errno
+	}
+	var list []byte
+	for _, x := range xattrs {
+		if x.value(f) == "" {
+			continue
+		}
+		list = append(list, XattrPrefix+x.name...)
+		list = append(list, 0)
+	}
+	for key := range f.Properties {
+		list = append(list, XattrPropPrefix+key...)
+		list = append(list, 0)
+	}
+	return copyXattr(dest, list)
+}
+
+func (cn *commonNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if data == nil {
+		// nil means removing in setXattr.
+		data = []byte{}
+	}
+	return cn.setXattr(ctx, attr, data, flags)
+}
+
+func (cn *commonNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return cn.setXattr(ctx, attr, nil, 0)
+}
+
+// setXattr sets the extended attribute to value, or removes it when value is
+// nil.
+func (cn *commonNode) setXattr(ctx context.Context, attr string, value []byte, flags uint32) syscall.Errno {
+	key := strings.TrimPrefix(attr, XattrPropPrefix)
+	isProp := key != attr && key != ""
+	name := strings.TrimPrefix(attr, XattrPrefix)
+	if !isProp && name == attr {
+		return syscall.ENOTSUP
+	}
+	if errno := cn.checkWritable(); errno != 0 {
+		return errno
+	}
+	if cn.id == "" {
+		// Not yet created on Drive.
+		return syscall.EAGAIN
+	}
+	if isProp && len(key)+len(value) > MaxPropertySize {
+		return syscall.E2BIG
+	}
+
+	f, errno := cn.loadXattrs(ctx)
+	if errno != 0 {
+		return errno
+	}
+	meta := new(drive.File)
+	var exists bool
+	// Starring is per user, everything else changes the file.
+	requireEdit := true
+	if isProp {
+		_, exists = f.Properties[key]
+		if value == nil {
+			meta.ForceSendFields = []string{"Properties"}
+			meta.NullFields = []string{"Properties." + key}
+		} else {
+			meta.Properties = map[string]string{key: string(value)}
+		}
+	} else {
+		i := -1
+		for j, x := range xattrs {
+			if x.name == name {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return syscall.ENODATA
+		}
+		x := xattrs[i]
+		if x.set == nil {
+			// read only
+			return syscall.EPERM
+		}
+		exists = x.value(f) != ""
+		if errno := x.set(meta, value); errno != 0 {
+			return errno
+		}
+		requireEdit = name != "starred"
+	}
+
+	switch {
+	case value == nil && !exists:
+		return syscall.ENODATA
+	case flags&xattrCreate != 0 && exists:
+		return syscall.EEXIST
+	case flags&xattrReplace != 0 && !exists:
+		return syscall.ENODATA
+	case requireEdit && f.Capabilities != nil && !f.Capabilities.CanEdit:
+		return syscall.EACCES
+	}
+
+	f, err := cn.tc.NewChild().UpdateByID(ctx, cn.id, xattrFields, meta)
+	if err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusBadRequest {
+			// Property sizes are already checked against MaxPropertySize.
+			return syscall.EINVAL
+		}
+		return syscall.EREMOTEIO
+	}
+	cn.xattrLock.Lock()
+	defer cn.xattrLock.Unlock()
+	cn.xattrFile = f
+	cn.xattrLoaded = time.Now()
+	return 0
+}
+
+// Flags used by setxattr.
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
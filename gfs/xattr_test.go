@@ -0,0 +1,325 @@
+package gfs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// getxattr gets the extended attribute from node the way the kernel does,
+// by querying the size first.
+func getxattr(t *testing.T, node *commonNode, attr string) (string, syscall.Errno) {
+	t.Helper()
+	ctx := context.Background()
+	size, errno := node.Getxattr(ctx, attr, nil)
+	if errno != syscall.ERANGE {
+		return "", errno
+	}
+	dest := make([]byte, size)
+	n, errno := node.Getxattr(ctx, attr, dest)
+	if errno != 0 {
+		return "", errno
+	}
+	return string(dest[:n]), 0
+}
+
+func TestGetxattr(t *testing.T) {
+	fd := newFakeDrive(t)
+	root := fd.mount(Options{}, MountOptions{})
+	id := fd.add(&drive.File{
+		Name:        "file",
+		Description: "a file",
+		Properties:  map[string]string{"color": "red"},
+	}, []byte("content"))
+	fn := lookup(t, root, "file").(*fileNode)
+
+	for _, c := range []struct {
+		Attr     string
+		Expected string
+		Errno    syscall.Errno
+	}{
+		{Attr: XattrPrefix + "id", Expected: id},
+		{Attr: XattrPrefix + "description", Expected: "a file"},
+		{Attr: XattrPrefix + "starred", Expected: "false"},
+		{Attr: XattrPropPrefix + "color", Expected: "red"},
+		{Attr: XattrPropPrefix + "size", Errno: syscall.ENODATA},
+		{Attr: XattrPropPrefix, Errno: syscall.ENODATA},
+		{Attr: XattrPrefix + "webViewLink", Errno: syscall.ENODATA},
+		{Attr: XattrPrefix + "foo", Errno: syscall.ENODATA},
+		{Attr: "user.foo", Errno: syscall.ENODATA},
+	} {
+		t.Run(c.Attr, func(t *testing.T) {
+			value, errno := getxattr(t, &fn.commonNode, c.Attr)
+			if errno != c.Errno {
+				t.Fatalf("Getxattr expected errno %v, got %v", c.Errno, errno)
+			}
+			if value != c.Expected {
+				t.Errorf("Getxattr expected %q, got %q", c.Expected, value)
+			}
+		})
+	}
+
+	t.Run("small-buffer", func(t *testing.T) {
+		dest := make([]byte, 2)
+		size, errno := fn.Getxattr(context.Background(), XattrPrefix+"description", dest)
+		if errno != syscall.ERANGE {
+			t.Errorf("Getxattr expected ERANGE, got %v", errno)
+		}
+		if size != uint32(len("a file")) {
+			t.Errorf("Getxattr expected size %d, got %d", len("a file"), size)
+		}
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		before := fd.count("GET files")
+		getxattr(t, &fn.commonNode, XattrPrefix+"md5")
+		if n := fd.count("GET files") - before; n != 0 {
+			t.Errorf("Expected cached metadata to be used, got %d requests", n)
+		}
+	})
+}
+
+func TestListxattr(t *testing.T) {
+	fd := newFakeDrive(t)
+	root := fd.mount(Options{}, MountOptions{})
+	fd.add(&drive.File{
+		Name:       "file",
+		MimeType:   "text/plain",
+		Properties: map[string]string{"color": "red"},
+	}, []byte("content"))
+	fn := lookup(t, root, "file").(*fileNode)
+
+	ctx := context.Background()
+	size, errno := fn.Listxattr(ctx, nil)
+	if errno != syscall.ERANGE {
+		t.Fatalf("Listxattr size query expected ERANGE, got %v", errno)
+	}
+	dest := make([]byte, size)
+	n, errno := fn.Listxattr(ctx, dest)
+	if errno != 0 {
+		t.Fatalf("Listxattr failed: %v", errno)
+	}
+	names := strings.Split(strings.TrimSuffix(string(dest[:n]), "\x00"), "\x00")
+	sort.Strings(names)
+	expected := []string{
+		XattrPrefix + "headRevisionId",
+		XattrPrefix + "id",
+		XattrPrefix + "md5",
+		XattrPrefix + "mimeType",
+		XattrPrefix + "parents",
+		XattrPrefix + "starred",
+		XattrPropPrefix + "color",
+	}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Listxattr expected %v, got %v", expected, names)
+	}
+}
+
+func TestSetxattr(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		Label    string
+		Attr     string
+		Value    []byte
+		Remove   bool
+		Flags    uint32
+		CanEdit  bool
+		Errno    syscall.Errno
+		Expected func(f *drive.File) bool
+	}{
+		{
+			Label:    "prop-new",
+			Attr:     XattrPropPrefix + "shape",
+			Value:    []byte("round"),
+			CanEdit:  true,
+			Expected: func(f *drive.File) bool { return f.Properties["shape"] == "round" && f.Properties["color"] == "red" },
+		},
+		{
+			Label:    "prop-replace",
+			Attr:     XattrPropPrefix + "color",
+			Value:    []byte("blue"),
+			Flags:    xattrReplace,
+			CanEdit:  true,
+			Expected: func(f *drive.File) bool { return f.Properties["color"] == "blue" },
+		},
+		{
+			Label:   "prop-create-exists",
+			Attr:    XattrPropPrefix + "color",
+			Value:   []byte("blue"),
+			Flags:   xattrCreate,
+			CanEdit: true,
+			Errno:   syscall.EEXIST,
+		},
+		{
+			Label:   "prop-replace-missing",
+			Attr:    XattrPropPrefix + "shape",
+			Value:   []byte("round"),
+			Flags:   xattrReplace,
+			CanEdit: true,
+			Errno:   syscall.ENODATA,
+		},
+		{
+			Label:   "prop-too-big",
+			Attr:    XattrPropPrefix + "color",
+			Value:   []byte(strings.Repeat("x", MaxPropertySize)),
+			CanEdit: true,
+			Errno:   syscall.E2BIG,
+		},
+		{
+			Label:    "prop-remove",
+			Attr:     XattrPropPrefix + "color",
+			Remove:   true,
+			CanEdit:  true,
+			Expected: func(f *drive.File) bool { _, ok := f.Properties["color"]; return !ok },
+		},
+		{
+			Label:   "prop-remove-missing",
+			Attr:    XattrPropPrefix + "shape",
+			Remove:  true,
+			CanEdit: true,
+			Errno:   syscall.ENODATA,
+		},
+		{
+			Label: "prop-no-edit",
+			Attr:  XattrPropPrefix + "color",
+			Value: []byte("blue"),
+			Errno: syscall.EACCES,
+		},
+		{
+			Label:    "description",
+			Attr:     XattrPrefix + "description",
+			Value:    []byte("a file"),
+			CanEdit:  true,
+			Expected: func(f *drive.File) bool { return f.Description == "a file" },
+		},
+		{
+			Label:    "starred-no-edit",
+			Attr:     XattrPrefix + "starred",
+			Value:    []byte("true"),
+			Expected: func(f *drive.File) bool { return f.Starred },
+		},
+		{
+			Label:   "starred-invalid",
+			Attr:    XattrPrefix + "starred",
+			Value:   []byte("yes please"),
+			CanEdit: true,
+			Errno:   syscall.EINVAL,
+		},
+		{
+			Label:   "read-only",
+			Attr:    XattrPrefix + "id",
+			Value:   []byte("foo"),
+			CanEdit: true,
+			Errno:   syscall.EPERM,
+		},
+		{
+			Label:   "unknown",
+			Attr:    XattrPrefix + "foo",
+			Value:   []byte("foo"),
+			CanEdit: true,
+			Errno:   syscall.ENODATA,
+		},
+		{
+			Label:   "other-namespace",
+			Attr:    "user.foo",
+			Value:   []byte("foo"),
+			CanEdit: true,
+			Errno:   syscall.ENOTSUP,
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			fd := newFakeDrive(t)
+			root := fd.mount(Options{}, MountOptions{})
+			id := fd.add(&drive.File{
+				Name:         "file",
+				Properties:   map[string]string{"color": "red"},
+				Capabilities: &drive.FileCapabilities{CanEdit: c.CanEdit},
+			}, []byte("content"))
+			fn := lookup(t, root, "file").(*fileNode)
+
+			var errno syscall.Errno
+			if c.Remove {
+				errno = fn.Removexattr(ctx, c.Attr)
+			} else {
+				errno = fn.Setxattr(ctx, c.Attr, c.Value, c.Flags)
+			}
+			if errno != c.Errno {
+				t.Fatalf("Expected errno %v, got %v", c.Errno, errno)
+			}
+			if c.Errno != 0 {
+				if n := fd.count("PATCH files"); n != 0 {
+					t.Errorf("Expected no updates on error, got %d", n)
+				}
+				return
+			}
+			if !c.Expected(fd.get(id)) {
+				t.Errorf("Unexpected file on Drive: %+v", fd.get(id))
+			}
+			// The cached metadata is updated.
+			if c.Remove {
+				if _, errno := getxattr(t, &fn.commonNode, c.Attr); errno != syscall.ENODATA {
+					t.Errorf("Getxattr after remove expected ENODATA, got %v", errno)
+				}
+			} else {
+				value, errno := getxattr(t, &fn.commonNode, c.Attr)
+				if errno != 0 || value != string(c.Value) {
+					t.Errorf("Getxattr after set expected %q, got %q, %v", c.Value, value, errno)
+				}
+			}
+		})
+	}
+}
+
+func TestSetxattrBadRequest(t *testing.T) {
+	for _, c := range []struct {
+		Label string
+		Code  int
+		Body  string
+		Errno syscall.Errno
+	}{
+		{
+			Label: "too-large",
+			Code:  http.StatusBadRequest,
+			Body:  `{"error": {"code": 400, "message": "The property exceeds the maximum size limit.", "errors": [{"reason": "badRequest", "message": "The property exceeds the maximum size limit."}]}}`,
+			Errno: syscall.EINVAL,
+		},
+		{
+			Label: "invalid",
+			Code:  http.StatusBadRequest,
+			Body:  `{"error": {"code": 400, "message": "Invalid property key.", "errors": [{"reason": "invalid", "message": "Invalid property key."}]}}`,
+			Errno: syscall.EINVAL,
+		},
+		{
+			Label: "server-error",
+			Code:  http.StatusInternalServerError,
+			Body:  `{"error": {"code": 500, "message": "Internal Error"}}`,
+			Errno: syscall.EREMOTEIO,
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			fd := newFakeDrive(t)
+			root := fd.mount(Options{}, MountOptions{})
+			fd.add(&drive.File{Name: "file"}, []byte("content"))
+			fn := lookup(t, root, "file").(*fileNode)
+			fd.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodPatch {
+					return false
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(c.Code)
+				io.WriteString(w, c.Body)
+				return true
+			}
+			errno := fn.Setxattr(context.Background(), XattrPropPrefix+"color", []byte("red"), 0)
+			if errno != c.Errno {
+				t.Errorf("Setxattr expected %v, got %v", c.Errno, errno)
+			}
+		})
+	}
+}
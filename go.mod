@@ -1,19 +1,35 @@
 module go.yhsif.com/godrive-fuse
 
-go 1.15
+go 1.18
 
 require (
-	github.com/getsentry/sentry-go v0.6.1 // indirect
-	github.com/go-kit/kit v0.10.0 // indirect
 	github.com/hanwen/go-fuse/v2 v2.0.3
 	github.com/hashicorp/golang-lru v0.5.1
-	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
 	github.com/reddit/baseplate.go v0.2.1
 	go.uber.org/zap v1.15.0
-	golang.org/x/net v0.0.0-20200421231249-e086a090c8fd
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.19.0
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
-	golang.org/x/sys v0.0.0-20200523222454-059865788121 // indirect
 	google.golang.org/api v0.22.0
 	gopkg.in/sevlyar/go-daemon.v0 v0.1.5
 	gopkg.in/yaml.v2 v2.3.0
 )
+
+require (
+	cloud.google.com/go v0.38.0 // indirect
+	github.com/getsentry/sentry-go v0.6.1 // indirect
+	github.com/go-kit/kit v0.10.0 // indirect
+	github.com/golang/groupcache v0.0.0-20190702054246-869f871628b6 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/googleapis/gax-go/v2 v2.0.5 // indirect
+	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
+	go.opencensus.io v0.22.2 // indirect
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/tools v0.16.1 // indirect
+	google.golang.org/appengine v1.5.0 // indirect
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55 // indirect
+	google.golang.org/grpc v1.27.0 // indirect
+)
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// LoopbackTimeout is how long the loopback flow waits for the user to finish
+// the authorization in the browser.
+const LoopbackTimeout = time.Minute * 5
+
+// Errors returned by the loopback flow.
+var (
+	errStateMismatch = errors.New("state mismatch in oauth redirect")
+	errNoCode        = errors.New("no code in oauth redirect")
+)
+
+// randomString returns a url safe random string of n random bytes.
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// pkceChallenge returns the S256 code challenge of the PKCE verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type loopbackResult struct {
+	code string
+	err  error
+}
+
+// loopbackFlow runs the installed app loopback OAuth flow with PKCE.
+//
+// It listens on a random port on 127.0.0.1 to receive the redirect,
+// calls openURL with the url the user need to open in the browser,
+// then exchanges the code from the redirect for the token.
+func loopbackFlow(
+	ctx context.Context,
+	config *oauth2.Config,
+	openURL func(url string),
+) (*oauth2.Token, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	cfg := *config
+	cfg.RedirectURL = fmt.Sprintf("http://%s/", listener.Addr())
+
+	results := make(chan loopbackResult, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			var result loopbackResult
+			switch {
+			case subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1:
+				result.err = errStateMismatch
+			case query.Get("error") != "":
+				result.err = fmt.Errorf("oauth authorization failed: %s", query.Get("error"))
+			case query.Get("code") == "":
+				result.err = errNoCode
+			default:
+				result.code = query.Get("code")
+			}
+			if result.err != nil {
+				http.Error(w, result.err.Error(), http.StatusBadRequest)
+				if result.err == errStateMismatch {
+					// Could be a forged request, keep waiting for the real one.
+					return
+				}
+			} else {
+				fmt.Fprintln(w, "Authorization succeeded, you can close this window now.")
+			}
+			select {
+			case results <- result:
+			default:
+			}
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	openURL(cfg.AuthCodeURL(
+		state,
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	))
+
+	timer := time.NewTimer(LoopbackTimeout)
+	defer timer.Stop()
+	var result loopbackResult
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, errors.New("timed out waiting for oauth redirect")
+	case result = <-results:
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+	return cfg.Exchange(
+		ctx,
+		result.code,
+		oauth2.SetAuthURLParam("code_verifier", verifier),
+	)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestLoopbackFlow(t *testing.T) {
+	const (
+		code        = "fake-code"
+		accessToken = "fake-access-token"
+	)
+	var challenge string
+	tokenServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := r.ParseForm(); err != nil {
+				t.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if got := r.PostForm.Get("code"); got != code {
+				t.Errorf("Token endpoint expected code %q, got %q", code, got)
+				http.Error(w, "bad code", http.StatusBadRequest)
+				return
+			}
+			if got := pkceChallenge(r.PostForm.Get("code_verifier")); got != challenge {
+				t.Errorf("Token endpoint expected challenge %q, got %q", challenge, got)
+				http.Error(w, "bad verifier", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  accessToken,
+				"token_type":    "Bearer",
+				"refresh_token": "fake-refresh-token",
+				"expires_in":    3600,
+			})
+		},
+	))
+	defer tokenServer.Close()
+
+	config := &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  "https://auth.example.com/auth",
+			TokenURL: tokenServer.URL,
+		},
+	}
+
+	// redirect simulates the browser redirect after the user authorized.
+	//
+	// It's called from a non-test goroutine, so it must not call t.Fatal.
+	redirect := func(t *testing.T, authURL string, state string) *http.Response {
+		t.Helper()
+		u, err := url.Parse(authURL)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		query := u.Query()
+		if method := query.Get("code_challenge_method"); method != "S256" {
+			t.Errorf("Expected code_challenge_method S256, got %q", method)
+		}
+		challenge = query.Get("code_challenge")
+		redirectURL, err := url.Parse(query.Get("redirect_uri"))
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if state == "" {
+			state = query.Get("state")
+		}
+		redirectURL.RawQuery = url.Values{
+			"code":  {code},
+			"state": {state},
+		}.Encode()
+		resp, err := http.Get(redirectURL.String())
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run(
+		"success",
+		func(t *testing.T) {
+			tok, err := loopbackFlow(context.Background(), config, func(authURL string) {
+				go redirect(t, authURL, "")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.AccessToken != accessToken {
+				t.Errorf("Expected access token %q, got %q", accessToken, tok.AccessToken)
+			}
+		},
+	)
+
+	t.Run(
+		"state-mismatch",
+		func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			_, err := loopbackFlow(ctx, config, func(authURL string) {
+				go func() {
+					resp := redirect(t, authURL, "forged-state")
+					if resp != nil && resp.StatusCode != http.StatusBadRequest {
+						t.Errorf("Expected forged state to be rejected, got %d", resp.StatusCode)
+					}
+					cancel()
+				}()
+			})
+			if err != context.Canceled {
+				t.Errorf("Expected forged redirect to be ignored, got %v", err)
+			}
+		},
+	)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"sort"
 
 	"github.com/reddit/baseplate.go/log"
 	"golang.org/x/net/context"
@@ -24,46 +25,125 @@ func main() {
 		return
 	}
 
+	var authCmd string
+	if cmd == "auth" {
+		authCmd = parseAuthArgs(flag.Args()[1:])
+	}
+
 	cfg, _ := ParseConfigFromDir(*configDir)
 
 	log.InitLogger(cfg.LogLevel)
 	defer log.Sync()
 
-	client := GetOAuthClient(
-		getClientContext(context.Background(), cfg.HTTPClient),
-		Args{
-			Directory: *configDir,
-			Profile:   *profile,
-		},
-		cfg.OAuthClient,
-	)
-	srv, err := drive.New(client)
-	if err != nil {
-		log.Fatalw("Unable to retrieve Drive client", "err", err)
+	switch cmd {
+	default:
+		flag.Usage()
+		return
+	case "auth":
+		runAuth(cfg, authCmd)
+		return
+	case "mount":
 	}
 
 	var mountpoints gfs.Mountpoints
 	if flag.Arg(1) != "" {
 		if flag.Arg(2) != "" {
-			mountpoints = gfs.Mountpoints{flag.Arg(2): flag.Arg(1)}
+			mountpoints = gfs.Mountpoints{flag.Arg(2): {Source: flag.Arg(1)}}
 		} else {
-			mountpoints = gfs.Mountpoints{flag.Arg(1): "/"}
+			mountpoints = gfs.Mountpoints{flag.Arg(1): {}}
 		}
 	} else {
 		mountpoints = cfg.Mountpoints
 	}
+	groups := groupByProfile(mountpoints, *profile)
 
-	switch cmd {
-	default:
-		flag.Usage()
+	// The daemon has no terminal to prompt the passphrase.
+	if cfg.TokenStore.prompts() && !*noDaemon {
+		log.Fatalw(
+			"Encrypted token store needs one of passphrase_env, passphrase_file, key_file and key_command to run as a daemon, or use -no-daemon to prompt the passphrase",
+		)
+	}
+
+	// Only load the tokens in the daemon,
+	// the parent process exits right after forking it.
+	child, d := runDaemon(cfg.Daemon)
+	if !child {
 		return
-	case "mount":
-		child, d := runDaemon(cfg.Daemon)
-		if child {
-			if d != nil {
-				defer d.Release()
-			}
-			gfs.MountAll(srv, mountpoints)
+	}
+	if d != nil {
+		defer d.Release()
+	}
+	ctx := getClientContext(context.Background(), cfg.HTTPClient)
+	clients := newClients(ctx, cfg, groups)
+	mountpoints = make(gfs.Mountpoints)
+	for _, group := range groups {
+		for to, mo := range group {
+			mountpoints[to] = mo
+		}
+	}
+	gfs.MountAll(clients, mountpoints, cfg.FS)
+}
+
+// groupByProfile groups the mountpoints by their profiles,
+// mountpoints without a profile use defaultProfile.
+func groupByProfile(mountpoints gfs.Mountpoints, defaultProfile string) map[string]gfs.Mountpoints {
+	groups := make(map[string]gfs.Mountpoints)
+	for to, mo := range mountpoints {
+		if mo.Profile == "" {
+			mo.Profile = defaultProfile
+		}
+		if groups[mo.Profile] == nil {
+			groups[mo.Profile] = make(gfs.Mountpoints)
+		}
+		groups[mo.Profile][to] = mo
+	}
+	return groups
+}
+
+// newClients creates one client per profile in groups,
+// shared by all the mountpoints using it.
+//
+// Profiles failed to create clients are logged and skipped,
+// so that they don't block the mountpoints of other profiles.
+func newClients(ctx context.Context, cfg Config, groups map[string]gfs.Mountpoints) map[string]gfs.Client {
+	// Share the token store so that the passphrase is only asked once.
+	store := NewTokenStore(*configDir, cfg.TokenStore)
+	clients := make(map[string]gfs.Client, len(groups))
+	for profile, group := range groups {
+		mountpoints := make([]string, 0, len(group))
+		for to := range group {
+			mountpoints = append(mountpoints, to)
+		}
+		sort.Strings(mountpoints)
+
+		// Never block on authorizing in mount, use auth login command instead.
+		args := ProfileArgs(cfg, *configDir, profile)
+		args.NoAuth = true
+		args.Store = store
+		client, scopes, err := GetOAuthClient(ctx, args, cfg.OAuthClient)
+		if err != nil {
+			log.Errorw(
+				"Unable to create client for the profile, skipping its mountpoints",
+				"profile", profile,
+				"mountpoints", mountpoints,
+				"err", err,
+			)
+			continue
+		}
+		srv, err := drive.New(client)
+		if err != nil {
+			log.Errorw(
+				"Unable to retrieve Drive client, skipping its mountpoints",
+				"profile", profile,
+				"mountpoints", mountpoints,
+				"err", err,
+			)
+			continue
+		}
+		clients[profile] = gfs.Client{
+			Service: srv,
+			Scopes:  scopes,
 		}
 	}
+	return clients
 }
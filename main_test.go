@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.yhsif.com/godrive-fuse/gfs"
+)
+
+func TestGroupByProfile(t *testing.T) {
+	mountpoints := gfs.Mountpoints{
+		"/mnt/a": {},
+		"/mnt/b": {Profile: "work"},
+		"/mnt/c": {Profile: "default", Source: "/foo"},
+		"/mnt/d": {Profile: "work", Source: "id:bar"},
+	}
+	expected := map[string]gfs.Mountpoints{
+		"default": {
+			"/mnt/a": {Profile: "default"},
+			"/mnt/c": {Profile: "default", Source: "/foo"},
+		},
+		"work": {
+			"/mnt/b": {Profile: "work"},
+			"/mnt/d": {Profile: "work", Source: "id:bar"},
+		},
+	}
+	if groups := groupByProfile(mountpoints, "default"); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, groups)
+	}
+	if mountpoints["/mnt/a"].Profile != "" {
+		t.Error("Input mountpoints changed")
+	}
+}
+
+func TestNewClientsSkipsFailedProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) {
+		*configDir = d
+	}(*configDir)
+	*configDir = dir
+
+	if err := ioutil.WriteFile(
+		filepath.Join(dir, "key.json"),
+		[]byte(`{"type": "service_account", "client_email": "sa@example.iam.gserviceaccount.com", "private_key": "key"}`),
+		0600,
+	); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Profiles: map[string]ProfileConfig{
+			"sa": {
+				ServiceAccount: ServiceAccountConfig{KeyFile: "key.json"},
+			},
+			"bad-key": {
+				ServiceAccount: ServiceAccountConfig{KeyFile: "missing.json"},
+			},
+		},
+	}
+	groups := groupByProfile(gfs.Mountpoints{
+		"/mnt/sa":         {Profile: "sa"},
+		"/mnt/bad-key":    {Profile: "bad-key"},
+		"/mnt/logged-out": {Profile: "logged-out"},
+	}, "default")
+
+	clients := newClients(context.Background(), cfg, groups)
+	if len(clients) != 1 {
+		t.Errorf("Expected 1 client, got %v", clients)
+	}
+	if client, ok := clients["sa"]; !ok || client.Service == nil {
+		t.Errorf("Expected client for profile sa, got %+v", client)
+	}
+}
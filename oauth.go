@@ -2,15 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/reddit/baseplate.go/log"
-	"github.com/reddit/baseplate.go/randbp"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
 )
 
 // OAuthClientConfig defines the configurations needed for the oauth client.
@@ -19,89 +22,274 @@ type OAuthClientConfig struct {
 	ClientSecret string `yaml:"client_secret"`
 }
 
+// ProfileConfig defines the configurations of a single profile.
+type ProfileConfig struct {
+	// The OAuth scopes to request, default is DefaultScopes.
+	// Scopes without a scheme are relative to ScopePrefix,
+	// e.g. "drive.readonly".
+	Scopes []string `yaml:"scopes"`
+
+	// The OAuth flow used to authorize, default is FlowLoopback.
+	Flow AuthFlow `yaml:"flow"`
+
+	// When KeyFile is set, authenticate as the service account instead,
+	// and oauth_client and Flow are not used.
+	ServiceAccount ServiceAccountConfig `yaml:"service_account"`
+}
+
+// AuthFlow defines how to get the token when authorizing a profile.
+type AuthFlow string
+
+// Supported AuthFlow values.
+const (
+	// Open the authorization url in a browser on the same machine,
+	// which redirects back to a temporary local http server.
+	FlowLoopback AuthFlow = "loopback"
+
+	// Enter a code at the verification url on another device,
+	// for headless servers.
+	FlowDevice AuthFlow = "device"
+)
+
+// authFlow returns the flow to use,
+// the -auth-flow flag takes precedence over the config.
+func (pc ProfileConfig) authFlow() AuthFlow {
+	if *authFlow != "" {
+		return AuthFlow(*authFlow)
+	}
+	return pc.Flow
+}
+
+// DefaultScopes are the OAuth scopes requested by default.
+var DefaultScopes = []string{
+	drive.DriveScope,
+}
+
+// ScopePrefix is the prefix of Google OAuth scopes.
+const ScopePrefix = "https://www.googleapis.com/auth/"
+
+// NormalizeScopes returns the full version of the scopes,
+// or DefaultScopes if it's empty.
+func NormalizeScopes(scopes []string) []string {
+	if len(scopes) == 0 {
+		return DefaultScopes
+	}
+	normalized := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !strings.Contains(scope, "://") {
+			scope = ScopePrefix + scope
+		}
+		normalized = append(normalized, scope)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// profileToken is the content of the profile token file.
+type profileToken struct {
+	oauth2.Token
+
+	// The scopes requested when authorizing the token.
+	RequestedScopes []string `json:"requested_scopes,omitempty"`
+	// The scopes actually granted to the token.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// requested returns the scopes requested when authorizing the token.
+//
+// Token files created before we store scopes always requested DefaultScopes.
+func (pt *profileToken) requested() []string {
+	if len(pt.RequestedScopes) == 0 {
+		return DefaultScopes
+	}
+	return pt.RequestedScopes
+}
+
+// granted returns the scopes granted to the token.
+func (pt *profileToken) granted() []string {
+	if len(pt.Scopes) == 0 {
+		return pt.requested()
+	}
+	return pt.Scopes
+}
+
 // Args passed to GetOAuthClient function.
 type Args struct {
 	Directory string
 	Profile   string
 	NoAuth    bool
+
+	// The normalized scopes to request, see NormalizeScopes.
+	Scopes []string
+
+	// The OAuth flow used to authorize, default is FlowLoopback.
+	Flow AuthFlow
+
+	// Used instead of the OAuth client and profile token if KeyFile is set.
+	ServiceAccount ServiceAccountConfig
+
+	// Where the profile tokens are stored.
+	// Default is plaintext files under Directory.
+	Store TokenStore
+
+	// Authorize again even if there's a valid token.
+	Force bool
 }
 
-// GetOAuthClient returns an HTTP client that's ready to be used with Drive API.
-func GetOAuthClient(
-	ctx context.Context,
-	args Args,
-	cfg OAuthClientConfig,
-) *http.Client {
-	config := &oauth2.Config{
+// ProfileArgs returns the Args of the profile from the config.
+func ProfileArgs(cfg Config, dir, profile string) Args {
+	pc := cfg.Profiles[profile]
+	return Args{
+		Directory: dir,
+		Profile:   profile,
+		Scopes:    NormalizeScopes(pc.Scopes),
+		Flow:      pc.authFlow(),
+
+		ServiceAccount: pc.ServiceAccount,
+		Store:          NewTokenStore(dir, cfg.TokenStore),
+	}
+}
+
+func (args Args) store() TokenStore {
+	if args.Store == nil {
+		return plainTokenStore{dir: args.Directory}
+	}
+	return args.Store
+}
+
+// config returns the oauth2 config requesting scopes,
+// or DefaultScopes if scopes is empty.
+func (cfg OAuthClientConfig) config(scopes []string) *oauth2.Config {
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	return &oauth2.Config{
 		ClientID:     cfg.ClientID,
 		ClientSecret: cfg.ClientSecret,
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  `https://accounts.google.com/o/oauth2/auth`,
 			TokenURL: `https://accounts.google.com/o/oauth2/token`,
 		},
-		RedirectURL: `urn:ietf:wg:oauth:2.0:oob`,
-		Scopes: []string{
-			`https://www.googleapis.com/auth/drive`,
-		},
+		Scopes: scopes,
+	}
+}
+
+// GetOAuthClient returns an HTTP client that's ready to be used with Drive API,
+// and the OAuth scopes granted to it.
+//
+// If the saved token was authorized with different scopes from args.Scopes,
+// it will be authorized again.
+//
+// If args.ServiceAccount is set, the client is authenticated as the service
+// account instead.
+//
+// It returns an error if the service account key is unusable,
+// or the profile needs to be authorized with args.NoAuth set.
+func GetOAuthClient(
+	ctx context.Context,
+	args Args,
+	cfg OAuthClientConfig,
+) (*http.Client, []string, error) {
+	if args.ServiceAccount.KeyFile != "" {
+		scopes := args.Scopes
+		if len(scopes) == 0 {
+			scopes = DefaultScopes
+		}
+		client, err := serviceAccountClient(ctx, args.Directory, args.ServiceAccount, scopes)
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"unable to authenticate with service account key %s: %w",
+				args.ServiceAccount.KeyFile,
+				err,
+			)
+		}
+		return client, scopes, nil
 	}
 
-	tokFile := filepath.Join(args.Directory, args.Profile+".json")
-	tok, err := tokenFromFile(tokFile)
+	config := cfg.config(args.Scopes)
+	store := args.store()
+	pt, err := store.Load(args.Profile)
+	if err == nil && args.Force {
+		err = errors.New("forced to authorize again")
+	}
+	if err == nil && !reflect.DeepEqual(pt.requested(), config.Scopes) {
+		err = fmt.Errorf(
+			"token was authorized with scopes %v, but %v are requested",
+			pt.requested(),
+			config.Scopes,
+		)
+	}
 	if err != nil {
 		if args.NoAuth {
-			log.Fatalw("Unable to authenticate", "profile", args.Profile, "err", err)
+			return nil, nil, fmt.Errorf("unable to authenticate, run auth login command first: %w", err)
 		}
-		tok = getTokenFromWeb(ctx, config)
-		saveToken(tokFile, tok)
+		log.Infow("Authorizing profile", "profile", args.Profile, "reason", err)
+		tok := getTokenFromWeb(ctx, config, args.Flow)
+		pt = &profileToken{
+			Token:           *tok,
+			RequestedScopes: config.Scopes,
+			Scopes:          grantedScopes(tok, config.Scopes),
+		}
+		saveToken(store, args.Profile, pt)
 	}
-	return config.Client(ctx, tok)
+	return oauth2.NewClient(ctx, newPersistentTokenSource(ctx, config, store, args.Profile, pt)), pt.granted(), nil
 }
 
-func getTokenFromWeb(ctx context.Context, config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL(fmt.Sprintf("state-%d", randbp.R.Uint64()))
-	fmt.Printf(
-		"Go to the following link in your browser then type the authorization code: \n%s\n",
-		authURL,
-	)
-
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalw("Unable to read authorization code", "err", err)
+// grantedScopes returns the scopes granted to tok.
+//
+// Only tokens freshly returned by the token endpoint have that information,
+// requested is returned for other tokens.
+func grantedScopes(tok *oauth2.Token, requested []string) []string {
+	if scope, ok := tok.Extra("scope").(string); ok && scope != "" {
+		return strings.Fields(scope)
 	}
+	return requested
+}
 
-	tok, err := config.Exchange(ctx, authCode)
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config, flow AuthFlow) *oauth2.Token {
+	var tok *oauth2.Token
+	var err error
+	switch flow {
+	default:
+		log.Fatalw("Unknown oauth flow", "flow", flow)
+	case "", FlowLoopback:
+		tok, err = loopbackFlow(ctx, config, func(url string) {
+			fmt.Printf(
+				"Go to the following link in your browser to authorize godrive-fuse: \n%s\n",
+				url,
+			)
+		})
+	case FlowDevice:
+		tok, err = deviceFlow(ctx, config, DeviceAuthURL, func(url, code string) {
+			fmt.Printf(
+				"Go to the following link on any device and enter code %s to authorize godrive-fuse: \n%s\n",
+				code,
+				url,
+			)
+		})
+	}
 	if err != nil {
-		log.Fatalw("Unable to retrieve token from web", "err", err)
+		log.Fatalw("Unable to retrieve token from web", "flow", flow, "err", err)
 	}
 	return tok
 }
 
 // Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
+func tokenFromFile(file string) (*profileToken, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	tok := &oauth2.Token{}
+	tok := &profileToken{}
 	err = json.NewDecoder(f).Decode(tok)
 	return tok, err
 }
 
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Fatalw("Unable to cache oauth token", "path", path, "err", err)
-	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			log.Fatalw("Unable to save oauth token", "path", path, "err", err)
-		}
-	}()
-
-	if err := json.NewEncoder(f).Encode(token); err != nil {
-		log.Fatalw("Unable to encode profile token json", "err", err)
+// Saves the token of the profile to the store.
+func saveToken(store TokenStore, profile string, token *profileToken) {
+	fmt.Printf("Saving credential of profile %s\n", profile)
+	if err := store.Save(profile, token); err != nil {
+		log.Fatalw("Unable to save oauth token", "profile", profile, "err", err)
 	}
 }
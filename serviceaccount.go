@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+)
+
+// ServiceAccountConfig defines the configurations to authenticate as a service
+// account instead of a user.
+type ServiceAccountConfig struct {
+	// The path to the JSON key file of the service account.
+	// Relative paths are relative to the config directory.
+	KeyFile string `yaml:"key_file"`
+
+	// The email of the user to impersonate with domain-wide delegation.
+	// If empty, the service account itself is used.
+	Subject string `yaml:"subject"`
+}
+
+// serviceAccountClient returns an HTTP client authenticated as the service
+// account.
+func serviceAccountClient(
+	ctx context.Context,
+	dir string,
+	cfg ServiceAccountConfig,
+	scopes []string,
+) (*http.Client, error) {
+	config, err := cfg.jwtConfig(dir, scopes)
+	if err != nil {
+		return nil, err
+	}
+	return config.Client(ctx), nil
+}
+
+// jwtConfig reads the key file of the service account,
+// relative to the config directory dir.
+func (cfg ServiceAccountConfig) jwtConfig(dir string, scopes []string) (*jwt.Config, error) {
+	path := os.ExpandEnv(cfg.KeyFile)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := google.JWTConfigFromJSON(key, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	config.Subject = cfg.Subject
+	return config, nil
+}
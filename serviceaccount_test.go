@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServiceAccountClient(t *testing.T) {
+	const (
+		subject     = "user@example.com"
+		scope       = "https://www.googleapis.com/auth/drive"
+		accessToken = "fake-access-token"
+	)
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			if len(parts) != 3 {
+				t.Errorf("Malformed assertion %q", r.FormValue("assertion"))
+				http.Error(w, "bad assertion", http.StatusBadRequest)
+				return
+			}
+			payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+			if err != nil {
+				t.Error(err)
+			}
+			var claims struct {
+				Sub   string `json:"sub"`
+				Scope string `json:"scope"`
+			}
+			if err := json.Unmarshal(payload, &claims); err != nil {
+				t.Error(err)
+			}
+			if claims.Sub != subject {
+				t.Errorf("Expected sub %q, got %q", subject, claims.Sub)
+			}
+			if claims.Scope != scope {
+				t.Errorf("Expected scope %q, got %q", scope, claims.Scope)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": accessToken,
+				"token_type":   "Bearer",
+				"expires_in":   3600,
+			})
+		},
+	))
+	defer tokenServer.Close()
+
+	apiServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			expected := "Bearer " + accessToken
+			if got := r.Header.Get("Authorization"); got != expected {
+				t.Errorf("Expected Authorization %q, got %q", expected, got)
+			}
+		},
+	))
+	defer apiServer.Close()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "sa@project.iam.gserviceaccount.com",
+		"private_key_id": "key-id",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenServer.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "service-account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.json"), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := serviceAccountClient(
+		context.Background(),
+		dir,
+		ServiceAccountConfig{
+			KeyFile: "key.json",
+			Subject: subject,
+		},
+		[]string{scope},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(apiServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
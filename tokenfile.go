@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/reddit/baseplate.go/log"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// writeTokenFile atomically replaces the token file at path with token.
+func writeTokenFile(path string, token *profileToken) error {
+	content, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// writeFileAtomic atomically replaces the file at path with content.
+//
+// The content is written into a temporary file in the same directory with 0600
+// permission first, then renamed to path.
+func writeFileAtomic(path string, content []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	// TempFile already creates it with 0600, just to be sure.
+	if err = f.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// lockTokenFile takes an exclusive lock for the token file at path,
+// shared with other processes.
+//
+// The lock is on a separate lock file,
+// as the token file itself is replaced on every write.
+// The returned function releases the lock.
+func lockTokenFile(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// persistentTokenSource is an oauth2.TokenSource that writes refreshed tokens
+// back to the token store.
+//
+// It's meant to be wrapped by oauth2.ReuseTokenSource,
+// so Token is only called when the current token expired.
+type persistentTokenSource struct {
+	ctx     context.Context
+	config  *oauth2.Config
+	store   TokenStore
+	profile string
+
+	lock    sync.Mutex
+	current *profileToken
+}
+
+func newPersistentTokenSource(
+	ctx context.Context,
+	config *oauth2.Config,
+	store TokenStore,
+	profile string,
+	current *profileToken,
+) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(&current.Token, &persistentTokenSource{
+		ctx:     ctx,
+		config:  config,
+		store:   store,
+		profile: profile,
+		current: current,
+	})
+}
+
+func (ts *persistentTokenSource) Token() (*oauth2.Token, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	load := ts.store.Load
+	unlock, err := ts.store.Lock(ts.profile)
+	if err != nil {
+		log.Warnw("Unable to lock token, refreshing without lock", "profile", ts.profile, "err", err)
+	} else {
+		defer unlock()
+		load = ts.store.LoadLocked
+	}
+
+	// Another process sharing the profile could have refreshed it already,
+	// or authorized it again and rotated the refresh token.
+	if pt, err := load(ts.profile); err == nil {
+		ts.current = pt
+		if pt.Valid() {
+			return &pt.Token, nil
+		}
+	}
+
+	tok, err := ts.config.TokenSource(ts.ctx, &ts.current.Token).Token()
+	if err != nil {
+		return nil, err
+	}
+	pt := *ts.current
+	pt.Token = *tok
+	if ts.changed(load) {
+		log.Warnw(
+			"Token changed by another process while refreshing, not saving the refreshed token",
+			"profile", ts.profile,
+		)
+	} else if err := ts.store.Save(ts.profile, &pt); err != nil {
+		log.Errorw("Unable to save refreshed oauth token", "profile", ts.profile, "err", err)
+	} else {
+		log.Debugw("Saved refreshed oauth token", "profile", ts.profile, "expiry", tok.Expiry)
+	}
+	ts.current = &pt
+	return tok, nil
+}
+
+// changed returns true if the saved token is different from the current one,
+// which means that another process changed it without honoring the lock.
+// The saved token is loaded with load, the one matching whether the lock of
+// the profile is held.
+//
+// It must be called with ts.lock held.
+func (ts *persistentTokenSource) changed(load func(profile string) (*profileToken, error)) bool {
+	pt, err := load(ts.profile)
+	if err != nil {
+		return false
+	}
+	return pt.AccessToken != ts.current.AccessToken || pt.RefreshToken != ts.current.RefreshToken
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestPersistentTokenSource(t *testing.T) {
+	var refreshes int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if got := r.FormValue("refresh_token"); got != "old-refresh-token" {
+				t.Errorf("Expected old refresh token, got %q", got)
+			}
+			atomic.AddInt32(&refreshes, 1)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  "new-access-token",
+				"token_type":    "Bearer",
+				"refresh_token": "new-refresh-token",
+				"expires_in":    3600,
+			})
+		},
+	))
+	defer tokenServer.Close()
+
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := plainTokenStore{dir: dir}
+	path := store.path("default")
+	expired := &profileToken{
+		Token: oauth2.Token{
+			AccessToken:  "old-access-token",
+			RefreshToken: "old-refresh-token",
+			Expiry:       time.Now().Add(-time.Hour),
+		},
+		RequestedScopes: []string{"scope"},
+	}
+	if err := writeTokenFile(path, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{
+			TokenURL: tokenServer.URL,
+		},
+	}
+	// Two sources sharing the same profile, like two daemons would do.
+	copied := *expired
+	sources := []oauth2.TokenSource{
+		newPersistentTokenSource(context.Background(), config, store, "default", expired),
+		newPersistentTokenSource(context.Background(), config, store, "default", &copied),
+	}
+	for i, ts := range sources {
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != "new-access-token" {
+			t.Errorf("Source %d expected new access token, got %q", i, tok.AccessToken)
+		}
+	}
+	if refreshes != 1 {
+		t.Errorf("Expected 1 refresh, got %d", refreshes)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected token file permission 0600, got %o", perm)
+	}
+	saved, err := tokenFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "new-access-token" || saved.RefreshToken != "new-refresh-token" {
+		t.Errorf("Refreshed token not saved, got %+v", saved.Token)
+	}
+	if len(saved.RequestedScopes) != 1 {
+		t.Errorf("Scopes not kept in saved token, got %v", saved.RequestedScopes)
+	}
+}
+
+func TestPersistentTokenSourceRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := plainTokenStore{dir: dir}
+	path := store.path("default")
+
+	// The token saved by another process after authorizing the profile again,
+	// also expired by now.
+	rotated := &profileToken{
+		Token: oauth2.Token{
+			AccessToken:  "rotated-access-token",
+			RefreshToken: "rotated-refresh-token",
+			Expiry:       time.Now().Add(-time.Minute),
+		},
+		RequestedScopes: []string{"scope"},
+	}
+	if err := writeTokenFile(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	// Changed by yet another process not honoring the lock while refreshing.
+	concurrent := &profileToken{
+		Token: oauth2.Token{
+			AccessToken:  "concurrent-access-token",
+			RefreshToken: "rotated-refresh-token",
+			Expiry:       time.Now().Add(time.Hour),
+		},
+		RequestedScopes: []string{"scope"},
+	}
+
+	for _, c := range []struct {
+		Label    string
+		Modify   bool
+		Expected string
+	}{
+		{
+			Label:    "rotated",
+			Expected: "new-access-token",
+		},
+		{
+			Label:    "changed-while-refreshing",
+			Modify:   true,
+			Expected: "concurrent-access-token",
+		},
+	} {
+		t.Run(c.Label, func(t *testing.T) {
+			if err := writeTokenFile(path, rotated); err != nil {
+				t.Fatal(err)
+			}
+			tokenServer := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					if got := r.FormValue("refresh_token"); got != "rotated-refresh-token" {
+						w.WriteHeader(http.StatusBadRequest)
+						json.NewEncoder(w).Encode(map[string]interface{}{
+							"error": "invalid_grant",
+						})
+						return
+					}
+					if c.Modify {
+						if err := writeTokenFile(path, concurrent); err != nil {
+							t.Error(err)
+						}
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"access_token": "new-access-token",
+						"token_type":   "Bearer",
+						"expires_in":   3600,
+					})
+				},
+			))
+			defer tokenServer.Close()
+
+			config := &oauth2.Config{
+				ClientID: "client",
+				Endpoint: oauth2.Endpoint{
+					TokenURL: tokenServer.URL,
+				},
+			}
+			stale := &profileToken{
+				Token: oauth2.Token{
+					AccessToken:  "old-access-token",
+					RefreshToken: "old-refresh-token",
+					Expiry:       time.Now().Add(-time.Hour),
+				},
+			}
+			ts := newPersistentTokenSource(context.Background(), config, store, "default", stale)
+			tok, err := ts.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.AccessToken != "new-access-token" {
+				t.Errorf("Expected new access token, got %q", tok.AccessToken)
+			}
+
+			saved, err := tokenFromFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.AccessToken != c.Expected {
+				t.Errorf("Expected saved access token %q, got %q", c.Expected, saved.AccessToken)
+			}
+			if saved.RefreshToken != "rotated-refresh-token" {
+				t.Errorf("Expected rotated refresh token kept, got %q", saved.RefreshToken)
+			}
+			if len(saved.RequestedScopes) != 1 {
+				t.Errorf("Scopes not kept in saved token, got %v", saved.RequestedScopes)
+			}
+		})
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/reddit/baseplate.go/log"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// TokenStore loads and saves the tokens of profiles.
+type TokenStore interface {
+	// Load loads the token of the profile.
+	Load(profile string) (*profileToken, error)
+
+	// LoadLocked is Load for callers holding the lock of the profile from Lock.
+	LoadLocked(profile string) (*profileToken, error)
+
+	// Save atomically replaces the token of the profile.
+	Save(profile string, token *profileToken) error
+
+	// Lock takes an exclusive lock of the profile shared with other processes,
+	// and returns the function to release it.
+	Lock(profile string) (func(), error)
+
+	// Delete deletes the token of the profile.
+	Delete(profile string) error
+
+	// List returns the names of all the profiles with tokens.
+	List() ([]string, error)
+}
+
+// TokenStoreConfig defines how profile tokens are stored.
+type TokenStoreConfig struct {
+	// Encrypt the tokens with a key from one of the key sources below,
+	// the first one set is used.
+	// If none of them are set, the passphrase will be prompted.
+	Encrypt bool `yaml:"encrypt"`
+
+	// The environment variable to read the passphrase from.
+	PassphraseEnv string `yaml:"passphrase_env"`
+
+	// The file to read the passphrase from.
+	PassphraseFile string `yaml:"passphrase_file"`
+
+	// The file containing the base64 encoded 32-byte key.
+	KeyFile string `yaml:"key_file"`
+
+	// The command to print the passphrase, e.g. "pass show godrive-fuse".
+	// It's run with "sh -c".
+	KeyCommand string `yaml:"key_command"`
+}
+
+// NewTokenStore creates the TokenStore for the profiles under dir.
+func NewTokenStore(dir string, cfg TokenStoreConfig) TokenStore {
+	plain := plainTokenStore{dir: dir}
+	if !cfg.Encrypt {
+		return plain
+	}
+	return &encryptedTokenStore{
+		plain: plain,
+		key:   cfg.keySource(),
+	}
+}
+
+// plainTokenStore stores tokens as plaintext JSON files.
+type plainTokenStore struct {
+	dir string
+}
+
+func (s plainTokenStore) path(profile string) string {
+	return filepath.Join(s.dir, profile+".json")
+}
+
+func (s plainTokenStore) Load(profile string) (*profileToken, error) {
+	return tokenFromFile(s.path(profile))
+}
+
+func (s plainTokenStore) LoadLocked(profile string) (*profileToken, error) {
+	return s.Load(profile)
+}
+
+func (s plainTokenStore) Save(profile string, token *profileToken) error {
+	return writeTokenFile(s.path(profile), token)
+}
+
+func (s plainTokenStore) Lock(profile string) (func(), error) {
+	return lockTokenFile(s.path(profile))
+}
+
+func (s plainTokenStore) Delete(profile string) error {
+	return os.Remove(s.path(profile))
+}
+
+func (s plainTokenStore) List() ([]string, error) {
+	return listProfiles(s.dir, ".json", func(profile string) bool {
+		// Other json files, for example service account keys,
+		// could also be in the directory.
+		token, err := s.Load(profile)
+		return err == nil && (token.AccessToken != "" || token.RefreshToken != "")
+	})
+}
+
+// listProfiles returns the profiles with files ending with ext under dir,
+// and accepted by filter.
+func listProfiles(dir, ext string, filter func(profile string) bool) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		return nil, err
+	}
+	profiles := make([]string, 0, len(matches))
+	for _, match := range matches {
+		profile := strings.TrimSuffix(filepath.Base(match), ext)
+		if filter == nil || filter(profile) {
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles, nil
+}
+
+// Parameters used to derive the key from a passphrase.
+const (
+	pbkdf2Iterations = 200000
+	saltSize         = 16
+	keySize          = 32
+)
+
+// Values of encryptedToken.KDF.
+const (
+	kdfNone   = "none"
+	kdfPBKDF2 = "pbkdf2-sha256"
+)
+
+// encryptedToken is the content of an encrypted token file.
+type encryptedToken struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// secret is the secret returned by key sources.
+type secret struct {
+	// Either a passphrase to derive the key from, or the key itself.
+	passphrase []byte
+	key        []byte
+}
+
+// encryptedTokenStore stores tokens encrypted with AES-GCM.
+type encryptedTokenStore struct {
+	plain plainTokenStore
+	key   func() (secret, error)
+
+	lock   sync.Mutex
+	secret *secret
+}
+
+func (s *encryptedTokenStore) path(profile string) string {
+	return filepath.Join(s.plain.dir, profile+".json.enc")
+}
+
+// getSecret returns the secret from the key source,
+// it's only read once and kept in memory so that refreshes don't prompt again.
+func (s *encryptedTokenStore) getSecret() (secret, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.secret != nil {
+		return *s.secret, nil
+	}
+	sec, err := s.key()
+	if err != nil {
+		return sec, fmt.Errorf("unable to get token encryption key: %w", err)
+	}
+	s.secret = &sec
+	return sec, nil
+}
+
+func (s *encryptedTokenStore) aead(sec secret, et *encryptedToken) (cipher.AEAD, error) {
+	var key []byte
+	switch et.KDF {
+	default:
+		return nil, fmt.Errorf("unknown kdf %q", et.KDF)
+	case kdfNone:
+		if sec.key == nil {
+			return nil, errors.New("token was encrypted with a key file, but a passphrase is configured")
+		}
+		key = sec.key
+	case kdfPBKDF2:
+		if sec.passphrase == nil {
+			return nil, errors.New("token was encrypted with a passphrase, but a key file is configured")
+		}
+		key = pbkdf2.Key(sec.passphrase, et.Salt, et.Iterations, keySize, sha256.New)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Load loads the encrypted token of the profile.
+//
+// If there's only a plaintext token of the profile,
+// it will be migrated to an encrypted one.
+func (s *encryptedTokenStore) Load(profile string) (*profileToken, error) {
+	return s.load(profile, false)
+}
+
+// LoadLocked is Load for callers holding the lock of the profile.
+func (s *encryptedTokenStore) LoadLocked(profile string) (*profileToken, error) {
+	return s.load(profile, true)
+}
+
+func (s *encryptedTokenStore) load(profile string, locked bool) (*profileToken, error) {
+	content, err := ioutil.ReadFile(s.path(profile))
+	if os.IsNotExist(err) {
+		return s.migrate(profile, locked)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(profile, content)
+}
+
+// decrypt decrypts the content of the encrypted token file of the profile.
+func (s *encryptedTokenStore) decrypt(profile string, content []byte) (*profileToken, error) {
+	var et encryptedToken
+	if err := json.Unmarshal(content, &et); err != nil {
+		return nil, err
+	}
+	sec, err := s.getSecret()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := s.aead(sec, &et)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, et.Nonce, et.Ciphertext, []byte(profile))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt token, wrong key? %w", err)
+	}
+	token := &profileToken{}
+	return token, json.Unmarshal(plaintext, token)
+}
+
+// migrate encrypts the plaintext token of the profile, if any.
+//
+// It's done with the lock of the profile,
+// which is taken unless the caller already holds it.
+func (s *encryptedTokenStore) migrate(profile string, locked bool) (*profileToken, error) {
+	if !locked {
+		unlock, err := s.Lock(profile)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	// Another process could have migrated it while we were waiting for the
+	// lock.
+	content, err := ioutil.ReadFile(s.path(profile))
+	if err == nil {
+		return s.decrypt(profile, content)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	token, err := s.plain.Load(profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Save(profile, token); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(s.plain.path(profile)); err != nil {
+		return nil, err
+	}
+	log.Infow("Migrated plaintext token to encrypted token", "profile", profile, "path", s.path(profile))
+	return token, nil
+}
+
+func (s *encryptedTokenStore) Save(profile string, token *profileToken) error {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	sec, err := s.getSecret()
+	if err != nil {
+		return err
+	}
+	et := encryptedToken{
+		KDF: kdfNone,
+	}
+	if sec.key == nil {
+		et.KDF = kdfPBKDF2
+		et.Iterations = pbkdf2Iterations
+		et.Salt = make([]byte, saltSize)
+		if _, err := rand.Read(et.Salt); err != nil {
+			return err
+		}
+	}
+	aead, err := s.aead(sec, &et)
+	if err != nil {
+		return err
+	}
+	et.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(et.Nonce); err != nil {
+		return err
+	}
+	et.Ciphertext = aead.Seal(nil, et.Nonce, plaintext, []byte(profile))
+	content, err := json.Marshal(et)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(profile), content)
+}
+
+func (s *encryptedTokenStore) Lock(profile string) (func(), error) {
+	return s.plain.Lock(profile)
+}
+
+// Delete deletes the encrypted token of the profile,
+// and also the plaintext one not yet migrated if any.
+func (s *encryptedTokenStore) Delete(profile string) error {
+	err := os.Remove(s.path(profile))
+	plainErr := s.plain.Delete(profile)
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return err
+	case plainErr != nil && !os.IsNotExist(plainErr):
+		return plainErr
+	case err == nil || plainErr == nil:
+		return nil
+	}
+	// Neither exists.
+	return err
+}
+
+// List returns the profiles with encrypted tokens,
+// and also the ones with plaintext tokens not yet migrated.
+func (s *encryptedTokenStore) List() ([]string, error) {
+	profiles, err := listProfiles(s.plain.dir, ".json.enc", nil)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := s.plain.List()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(profiles))
+	for _, profile := range profiles {
+		seen[profile] = true
+	}
+	for _, profile := range plain {
+		if !seen[profile] {
+			profiles = append(profiles, profile)
+		}
+	}
+	sort.Strings(profiles)
+	return profiles, nil
+}
+
+// prompts returns true if the passphrase will be prompted on the terminal.
+func (cfg TokenStoreConfig) prompts() bool {
+	return cfg.Encrypt &&
+		cfg.PassphraseEnv == "" &&
+		cfg.PassphraseFile == "" &&
+		cfg.KeyFile == "" &&
+		cfg.KeyCommand == ""
+}
+
+// keySource returns the function to get the secret configured.
+func (cfg TokenStoreConfig) keySource() func() (secret, error) {
+	switch {
+	case cfg.PassphraseEnv != "":
+		return func() (secret, error) {
+			passphrase := os.Getenv(cfg.PassphraseEnv)
+			if passphrase == "" {
+				return secret{}, fmt.Errorf("environment variable %s is empty", cfg.PassphraseEnv)
+			}
+			return secret{passphrase: []byte(passphrase)}, nil
+		}
+	case cfg.PassphraseFile != "":
+		return func() (secret, error) {
+			content, err := ioutil.ReadFile(os.ExpandEnv(cfg.PassphraseFile))
+			if err != nil {
+				return secret{}, err
+			}
+			return secret{passphrase: firstLine(content)}, nil
+		}
+	case cfg.KeyFile != "":
+		return func() (secret, error) {
+			content, err := ioutil.ReadFile(os.ExpandEnv(cfg.KeyFile))
+			if err != nil {
+				return secret{}, err
+			}
+			key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(content)))
+			if err != nil {
+				return secret{}, err
+			}
+			if len(key) != keySize {
+				return secret{}, fmt.Errorf("key must be %d bytes, got %d", keySize, len(key))
+			}
+			return secret{key: key}, nil
+		}
+	case cfg.KeyCommand != "":
+		return func() (secret, error) {
+			cmd := exec.Command("sh", "-c", cfg.KeyCommand)
+			cmd.Stderr = os.Stderr
+			output, err := cmd.Output()
+			if err != nil {
+				return secret{}, err
+			}
+			return secret{passphrase: firstLine(output)}, nil
+		}
+	default:
+		return promptPassphrase
+	}
+}
+
+// firstLine returns the first line of content, like how pass does it.
+func firstLine(content []byte) []byte {
+	if i := bytes.IndexByte(content, '\n'); i >= 0 {
+		content = content[:i]
+	}
+	return bytes.TrimSuffix(content, []byte("\r"))
+}
+
+// promptPassphrase prompts the passphrase on the terminal.
+func promptPassphrase() (secret, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return secret{}, fmt.Errorf("no terminal to prompt the passphrase: %w", err)
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, "Passphrase for token encryption: ")
+	if err := stty(tty, "-echo"); err == nil {
+		defer func() {
+			stty(tty, "echo")
+			fmt.Fprintln(tty)
+		}()
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return secret{}, err
+	}
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		return secret{}, errors.New("empty passphrase")
+	}
+	return secret{passphrase: []byte(passphrase)}, nil
+}
+
+func stty(tty *os.File, arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestEncryptedTokenCompatibility(t *testing.T) {
+	const env = "GODRIVE_FUSE_TEST_PASSPHRASE"
+	// Encrypted with passphrase "correct horse battery staple" by the
+	// PBKDF2-SHA256 implementation used before switching to x/crypto.
+	const content = `{"ciphertext":"Fbsjgihn2QZFKP5pr6DmIDvQP/Kev427bUx56DUqC2/rkKGwD1xjJoXdAWi0oEHdEhbYtO7x39lwp336eaSLN08FTTw6GEX2huZ1hflZLKTaLucu2WcqHlvs/ovHKbXKd/96+vZvtg3DLm7zbsUm","iterations":1000,"kdf":"pbkdf2-sha256","nonce":"MDEyMzQ1Njc4OWFi","salt":"MDEyMzQ1Njc4OWFiY2RlZg=="}`
+
+	dir, err := ioutil.TempDir("", "tokenstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv(env)
+
+	store := NewTokenStore(dir, TokenStoreConfig{
+		Encrypt:       true,
+		PassphraseEnv: env,
+	})
+	if err := ioutil.WriteFile(store.(*encryptedTokenStore).path("default"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(env, "correct horse battery staple")
+	token, err := store.Load("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "access-token" || token.RefreshToken != "refresh-token" {
+		t.Errorf("Unexpected token decrypted: %+v", token.Token)
+	}
+}
+
+func TestEncryptedTokenStore(t *testing.T) {
+	const (
+		profile = "default"
+		env     = "GODRIVE_FUSE_TEST_PASSPHRASE"
+	)
+	dir, err := ioutil.TempDir("", "tokenstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv(env)
+
+	plain := NewTokenStore(dir, TokenStoreConfig{})
+	token := &profileToken{
+		Token: oauth2.Token{
+			AccessToken:  "access-token",
+			RefreshToken: "refresh-token",
+		},
+		RequestedScopes: []string{"scope"},
+	}
+	if err := plain.Save(profile, token); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(env, "correct horse battery staple")
+	store := NewTokenStore(dir, TokenStoreConfig{
+		Encrypt:       true,
+		PassphraseEnv: env,
+	})
+	loaded, err := store.Load(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RefreshToken != token.RefreshToken {
+		t.Errorf("Expected refresh token %q, got %q", token.RefreshToken, loaded.RefreshToken)
+	}
+	if _, err := plain.Load(profile); !os.IsNotExist(err) {
+		t.Errorf("Expected plaintext token to be removed after migration, got %v", err)
+	}
+	content, err := ioutil.ReadFile(store.(*encryptedTokenStore).path(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{token.AccessToken, token.RefreshToken} {
+		if bytes.Contains(content, []byte(s)) {
+			t.Errorf("Encrypted token file contains %q in plaintext", s)
+		}
+	}
+
+	// A new store reading the migrated token.
+	loaded, err = NewTokenStore(dir, TokenStoreConfig{
+		Encrypt:       true,
+		PassphraseEnv: env,
+	}).Load(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.AccessToken != token.AccessToken {
+		t.Errorf("Expected access token %q, got %q", token.AccessToken, loaded.AccessToken)
+	}
+
+	os.Setenv(env, "wrong passphrase")
+	if _, err := NewTokenStore(dir, TokenStoreConfig{
+		Encrypt:       true,
+		PassphraseEnv: env,
+	}).Load(profile); err == nil {
+		t.Error("Expected error with wrong passphrase")
+	}
+}
+
+func TestEncryptedTokenStoreMigrateLock(t *testing.T) {
+	const (
+		profile = "default"
+		env     = "GODRIVE_FUSE_TEST_PASSPHRASE"
+	)
+	dir, err := ioutil.TempDir("", "tokenstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv(env)
+	os.Setenv(env, "correct horse battery staple")
+
+	plain := NewTokenStore(dir, TokenStoreConfig{})
+	token := &profileToken{
+		Token: oauth2.Token{
+			AccessToken:  "access-token",
+			RefreshToken: "refresh-token",
+		},
+	}
+	newStore := func() TokenStore {
+		return NewTokenStore(dir, TokenStoreConfig{
+			Encrypt:       true,
+			PassphraseEnv: env,
+		})
+	}
+	load := func(load func(profile string) (*profileToken, error)) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := load(profile)
+			done <- err
+		}()
+		return done
+	}
+
+	t.Run("held-by-other", func(t *testing.T) {
+		if err := plain.Save(profile, token); err != nil {
+			t.Fatal(err)
+		}
+		// Held by another process.
+		unlock, err := lockTokenFile(plainTokenStore{dir: dir}.path(profile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := load(newStore().Load)
+		select {
+		case err := <-done:
+			unlock()
+			t.Fatalf("Expected migration to wait for the lock, got %v", err)
+		case <-time.After(time.Millisecond * 100):
+		}
+		unlock()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Migration didn't finish after the lock is released")
+		}
+	})
+
+	t.Run("held-by-caller", func(t *testing.T) {
+		store := newStore()
+		if err := store.Delete(profile); err != nil {
+			t.Fatal(err)
+		}
+		if err := plain.Save(profile, token); err != nil {
+			t.Fatal(err)
+		}
+		// Like refreshing in persistentTokenSource.
+		unlock, err := store.Lock(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unlock()
+		select {
+		case err := <-load(store.LoadLocked):
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Migration deadlocked with the lock held by the caller")
+		}
+	})
+
+	t.Run("held-by-other-caller", func(t *testing.T) {
+		store := newStore()
+		if err := store.Delete(profile); err != nil {
+			t.Fatal(err)
+		}
+		if err := plain.Save(profile, token); err != nil {
+			t.Fatal(err)
+		}
+		// Held by another goroutine using the same store.
+		unlock, err := store.Lock(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := load(store.Load)
+		select {
+		case err := <-done:
+			unlock()
+			t.Fatalf("Expected migration to wait for the lock, got %v", err)
+		case <-time.After(time.Millisecond * 100):
+		}
+		unlock()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Migration didn't finish after the lock is released")
+		}
+	})
+}
+
+func TestEncryptedTokenStoreDelete(t *testing.T) {
+	const profile = "default"
+	dir, err := ioutil.TempDir("", "tokenstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewTokenStore(dir, TokenStoreConfig{
+		Encrypt: true,
+		KeyFile: filepath.Join(dir, "key"),
+	})
+	if err := store.Delete(profile); !os.IsNotExist(err) {
+		t.Errorf("Delete without tokens expected not exist error, got %v", err)
+	}
+
+	plain := NewTokenStore(dir, TokenStoreConfig{})
+	if err := plain.Save(profile, &profileToken{}); err != nil {
+		t.Fatal(err)
+	}
+	// Make removing the encrypted token fail.
+	enc := filepath.Join(dir, profile+".json.enc")
+	if err := os.MkdirAll(filepath.Join(enc, "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(profile); err == nil {
+		t.Error("Expected error when the encrypted token can't be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, profile+".json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the plaintext token removed, got %v", err)
+	}
+}